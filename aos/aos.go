@@ -3,23 +3,15 @@ package aos
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/astaxie/beego"
+	"service-broker/common"
 	http_client "service-broker/rest"
 )
 
-// AOS的地址
-var endpoint string
-
-func init() {
-	endpoint = beego.AppConfig.String("aos_endpoint")
-	beego.Info("endpoint: ", endpoint)
-}
-
 const (
 	APP_ROUTER_PREFIX       = "/v2/stacks"
 	APP_NAME_MAX_LENGTH     = 20
@@ -39,8 +31,15 @@ const (
 	INSTANCE_SUCCEEDED      = "succeeded"
 	INSTANCE_FAILED         = "failed"
 	APP_SCALE_INSTANCES_KEY = "instances"
+	LIFECYCLE_UPGRADE       = "upgrade"
+	INSTANCE_STACK_PREFIX   = "i"                    // 服务实例 stack 名称的前缀
+	ENV_UPDATE_MAX_RETRIES  = 5                      // 并发修改 env 冲突时的最大重试次数
+	ENV_UPDATE_RETRY_DELAY  = 200 * time.Millisecond // 重试间隔, 按次数递增
 )
 
+// 同一个节点的 BIND_SERVICES 读改写在 broker 内串行执行
+var envLocks = NewKeyedMutex()
+
 type CreateAppReq struct {
 	Name       string     `json:"name"`
 	TemplateId string     `json:"template_id"`
@@ -80,6 +79,18 @@ type StartAppReq struct {
 type QueryAppResp struct {
 	Status string `json:"status"`
 }
+
+// GET /v2/stacks 返回的 stack 列表
+type ListAppsResp struct {
+	Stacks []StackInfo `json:"stacks"`
+}
+type StackInfo struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	TemplateId string `json:"template_id,omitempty"`
+	ProjectId  string `json:"project_id,omitempty"`
+}
 type AppNodeResp struct {
 	RuntimeProperties map[string]interface{} `json:"runtime_properties"`
 	Instances         struct {
@@ -97,6 +108,8 @@ type AppNodeInfo struct {
 }
 type SetEnvbody struct {
 	BindEnv BindEnvInfo `json:"env"`
+	// AOS 返回资源版本时原样带回, 用于乐观并发控制
+	ResourceVersion string `json:"resource_version,omitempty"`
 }
 type BindEnvInfo struct {
 	BindServices map[string][]EnvSetEntity `json:"BIND_SERVICES"`
@@ -123,28 +136,7 @@ const (
 	MODE_DEL_OPERATE       = "DEL"
 )
 
-func GetStackName(prefix string, serviceName string, instanceId string) string {
-	if len(serviceName) > 12 {
-		serviceName = serviceName[0:12]
-	}
-	var stackName string
-	if len(instanceId) <= 5 {
-		stackName = prefix + "-" + serviceName + "-" + instanceId
-	} else {
-		stackName = prefix + "-" + serviceName + "-" + string(instanceId[0:5])
-	}
-	return strings.TrimRight(stackName, "-")
-}
-
-// 注意: 服务名称较短，这里截断后要防止出现名称重复, 前端要注意限制长度, 尾部字符不能是 -
-func GetAppFinalName(appName string) string {
-	if len(appName) > APP_NAME_MAX_LENGTH {
-		rs := []rune(appName)
-		appName = string(rs[0:APP_NAME_MAX_LENGTH])
-	}
-	return strings.TrimRight(appName, "-")
-}
-func CreateApp(appName, templateId string, inputsJson InputsJson, token, projectId string) (appId string, err error) {
+func (c *Client) CreateApp(appName, templateId string, inputsJson InputsJson, token, projectId string) (appId string, err error) {
 	path := APP_ROUTER_PREFIX
 	var appReq CreateAppReq
 	appReq.Name = appName
@@ -153,74 +145,81 @@ func CreateApp(appName, templateId string, inputsJson InputsJson, token, project
 	appReq.ProjectId = projectId
 	body, err := json.Marshal(appReq)
 	if err != nil {
-		beego.Error("Create application marshal request body error, error is: ", err)
+		c.Logger.Error("Create application marshal request body error, error is: ", err)
 		return
 	}
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	params := make(map[string]string)
-	resp, err := http_client.DoHTTPrequest("POST", endpoint, path, headers, params, body)
+	resp, err := c.HTTP.Do("POST", c.Endpoint, path, headers, params, body)
 	if err != nil {
-		beego.Error("Create application marshal request body error, error is: ", err)
+		c.Logger.Error("Create application marshal request body error, error is: ", err)
 		return
 	}
 	appRespBody, err := http_client.CopyResponseBody(resp)
 	if err != nil {
-		beego.Error("Create application copy response body error, error is: ", err)
+		c.Logger.Error("Create application copy response body error, error is: ", err)
 		return
 	}
 	if !http_client.IsResponseStatusOk(resp) {
-		err = errors.New("Create app from cfe error: " + string(appRespBody))
+		err = common.NewStatusError("Create app", resp.StatusCode, appRespBody)
 		return
 	}
 	var appResp CreateAppResp
 	err = json.Unmarshal(appRespBody, &appResp)
 	if err != nil {
-		beego.Error("Create application unmarshal response body error, error is: ", err)
+		c.Logger.Error("Create application unmarshal response body error, error is: ", err)
 		return
 	}
 	return appResp.Guid, nil
 }
 
 // 服务实例参数更新
-func UpdateInstancesInputs(appId, token string, inputs map[string]interface{}) (success bool, err error) {
-	beego.Info(fmt.Printf("UpdateInstancesInputs appid:%s, inputs:%d", appId, inputs))
+func (c *Client) UpdateInstancesInputs(appId, token string, inputs map[string]interface{}) (success bool, err error) {
+	c.Logger.Info("UpdateInstancesInputs appid: ", appId, ", inputs: ", inputs)
+	if err = c.RunAction(appId, token, LIFECYCLE_UPGRADE, inputs); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// 执行 blueprint 中定义的 action lifecycle, inputs 为该 lifecycle 的参数
+func (c *Client) RunAction(appId, token, lifecycle string, inputs map[string]interface{}) error {
 	path := APP_ROUTER_PREFIX + "/" + appId + "/actions"
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	var inputsReq InputsInstanceReq
-	inputsReq.Lifecycle = "upgrade"
+	inputsReq.Lifecycle = lifecycle
 	inputsReq.Inputs = inputs
 	reqBody, err := json.Marshal(inputsReq)
 	params := make(map[string]string)
 	if err != nil {
-		beego.Error("UpdateInstancesInputs marshal request body error, error is: ", err)
-		return
+		c.Logger.Error("Run action "+lifecycle+" marshal request body error, error is: ", err)
+		return common.WrapError("Run action "+lifecycle, err)
 	}
-	response, err := http_client.DoHTTPrequest("PUT", endpoint, path, headers, params, reqBody)
+	response, err := c.HTTP.Do("PUT", c.Endpoint, path, headers, params, reqBody)
 	if err != nil {
-		beego.Error("UpdateInstancesInputs error, error is: ", err)
-		return
+		c.Logger.Error("Run action "+lifecycle+" error, error is: ", err)
+		return common.WrapError("Run action "+lifecycle, err)
 	}
 	respBody, err := http_client.CopyResponseBody(response)
 	if err != nil {
-		beego.Error("UpdateInstancesInputs copy response body error, error is: ", err)
-		return
+		c.Logger.Error("Run action "+lifecycle+" copy response body error, error is: ", err)
+		return common.WrapError("Run action "+lifecycle, err)
 	}
-	beego.Info("UpdateInstancesInputs response body: ", string(respBody))
+	c.Logger.Info("Run action "+lifecycle+" response body: ", string(respBody))
 	if !http_client.IsResponseStatusOk(response) {
-		err = errors.New("UpdateInstancesInputs from AOS error: " + string(respBody))
-		return
+		return common.NewStatusError("Run action "+lifecycle, response.StatusCode, respBody)
 	}
-	return true, nil
+	return nil
 }
-func SetAppEnv(appId, nodeId, parameters, token string) (success bool, err error) {
+func (c *Client) SetAppEnv(appId, nodeId, parameters, token string) (success bool, err error) {
 	path := APP_ROUTER_PREFIX + "/" + appId + "/nodes/" + nodeId + "/properties"
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
-	resp, err := http_client.DoHTTPrequest("PUT", endpoint, path, headers, nil, []byte(parameters))
+	resp, err := c.HTTP.Do("PUT", c.Endpoint, path, headers, nil, []byte(parameters))
 	if err != nil {
-		beego.Error("Set application env app id: "+appId+" node id: "+nodeId+" do request error, error is: ", err)
+		c.Logger.Error("Set application env app id: "+appId+" node id: "+nodeId+" do request error, error is: ", err)
 		return
 	}
 	if http_client.IsResponseStatusOk(resp) {
@@ -231,15 +230,15 @@ func SetAppEnv(appId, nodeId, parameters, token string) (success bool, err error
 		var appRespBody []byte
 		appRespBody, err = http_client.CopyResponseBody(resp)
 		if err != nil {
-			beego.Error("Set application env app id: "+appId+" node id: "+nodeId+" copy response body error, error is: ", err)
+			c.Logger.Error("Set application env app id: "+appId+" node id: "+nodeId+" copy response body error, error is: ", err)
 			return
 		} else {
-			err = errors.New("Set app env, app id: " + appId + ", node id: " + nodeId + " ,error: " + string(appRespBody))
+			err = common.NewStatusError("Set app env, app id: "+appId+", node id: "+nodeId, resp.StatusCode, appRespBody)
 			return
 		}
 	}
 }
-func StartApp(appId, token string) (status int, success bool, err error) {
+func (c *Client) StartApp(appId, token string) (status int, success bool, err error) {
 	startAppReq := StartAppReq{
 		Op:        "replace",
 		Path:      "/spec/lifecycle",
@@ -251,12 +250,12 @@ func StartApp(appId, token string) (status int, success bool, err error) {
 	params := make(map[string]string)
 	body, err := json.Marshal(startAppReq)
 	if err != nil {
-		beego.Error("Start application marshal request body error, error is: ", err)
+		c.Logger.Error("Start application marshal request body error, error is: ", err)
 		return http.StatusBadRequest, success, err
 	}
-	resp, err := http_client.DoHTTPrequest("PUT", endpoint, path, headers, params, body)
+	resp, err := c.HTTP.Do("PUT", c.Endpoint, path, headers, params, body)
 	if err != nil {
-		beego.Error("Start application do request error, error is: ", err)
+		c.Logger.Error("Start application do request error, error is: ", err)
 		return http.StatusInternalServerError, success, err
 	}
 	if http_client.IsResponseStatusOk(resp) {
@@ -267,54 +266,108 @@ func StartApp(appId, token string) (status int, success bool, err error) {
 		var appRespBody []byte
 		appRespBody, err = http_client.CopyResponseBody(resp)
 		if err != nil {
-			beego.Error("Start application copy response body error, error is: ", err)
+			c.Logger.Error("Start application copy response body error, error is: ", err)
 			return resp.StatusCode, success, err
 		} else {
-			err = errors.New("Start app error: " + string(appRespBody))
+			err = common.NewStatusError("Start app", resp.StatusCode, appRespBody)
 			return resp.StatusCode, success, err
 		}
 	}
 }
-func QueryAppStatus(appId, token string) (status string, err error) {
+
+// 查询 project 下的 stack, name 非空时只返回同名的 stack
+func (c *Client) ListApps(name, token, projectId string) (stacks []StackInfo, err error) {
+	headers := make(map[string]string)
+	headers["X-Auth-Token"] = token
+	params := make(map[string]string)
+	if projectId != "" {
+		params["project_id"] = projectId
+	}
+	if name != "" {
+		params["name"] = name
+	}
+	resp, err := c.HTTP.Do("GET", c.Endpoint, APP_ROUTER_PREFIX, headers, params, []byte(""))
+	if err != nil {
+		c.Logger.Error("List applications do request error, error is: ", err)
+		return nil, common.WrapError("List apps", err)
+	}
+	respBody, err := http_client.CopyResponseBody(resp)
+	if err != nil {
+		c.Logger.Error("List applications copy response body error, error is: ", err)
+		return nil, common.WrapError("List apps", err)
+	}
+	if !http_client.IsResponseStatusOk(resp) {
+		return nil, common.NewStatusError("List apps", resp.StatusCode, respBody)
+	}
+	var listResp ListAppsResp
+	if err = json.Unmarshal(respBody, &listResp); err != nil {
+		c.Logger.Error("List applications unmarshal response body error, error is: ", err)
+		return nil, common.WrapError("List apps", err)
+	}
+	// 不依赖 AOS 对 name 参数的过滤, 这里再过滤一次
+	if name == "" {
+		return listResp.Stacks, nil
+	}
+	for _, stack := range listResp.Stacks {
+		if stack.Name == name {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks, nil
+}
+
+// 按名称查找 stack, 不存在时返回 nil
+func (c *Client) FindAppByName(name, token, projectId string) (*StackInfo, error) {
+	stacks, err := c.ListApps(name, token, projectId)
+	if err != nil {
+		return nil, err
+	}
+	if len(stacks) == 0 {
+		return nil, nil
+	}
+	return &stacks[0], nil
+}
+
+func (c *Client) QueryAppStatus(appId, token string) (status string, err error) {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	params := make(map[string]string)
 	path := APP_ROUTER_PREFIX + "/" + appId
 	var queryAppResp QueryAppResp
 	// 先用最外层的 status 来判断，后续根据应用编排组的修改来改
-	resp, err := http_client.DoHTTPrequest("GET", endpoint, path, headers, params, []byte(""))
+	resp, err := c.HTTP.Do("GET", c.Endpoint, path, headers, params, []byte(""))
 	if err != nil {
-		beego.Error("Check application status do request error, error is: ", err)
+		c.Logger.Error("Check application status do request error, error is: ", err)
 		return
 	}
 	appRespBody, err := http_client.CopyResponseBody(resp)
 	if err != nil {
-		beego.Error("Check application status copy response body error, error is: ", err)
+		c.Logger.Error("Check application status copy response body error, error is: ", err)
 		return
 	}
 	if !http_client.IsResponseStatusOk(resp) {
-		// err = errors.New("Query app status from cfe error: " + string(appRespBody))
-		beego.Error("Query app status from cfe error: " + string(appRespBody))
+		c.Logger.Error("Query app status from cfe error: " + string(appRespBody))
+		//404 说明 app 已不存在, 其它状态码无法判断 app 的状态
 		if resp.StatusCode == http.StatusNotFound {
-			status = APP_NOT_EXIST
+			return APP_NOT_EXIST, nil
 		}
-		return
+		return "", common.NewStatusError("Query app status", resp.StatusCode, appRespBody)
 	}
 	err = json.Unmarshal(appRespBody, &queryAppResp)
 	if err != nil {
-		beego.Error("Check application status unmarshal response body error, error is: ", err)
+		c.Logger.Error("Check application status unmarshal response body error, error is: ", err)
 		return
 	}
 	return queryAppResp.Status, nil
 }
-func DeleteApp(appId, token string) (status int, success bool, err error) {
+func (c *Client) DeleteApp(appId, token string) (status int, success bool, err error) {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	params := make(map[string]string)
 	path := APP_ROUTER_PREFIX + "/" + appId
-	resp, err := http_client.DoHTTPrequest("DELETE", endpoint, path, headers, params, []byte(""))
+	resp, err := c.HTTP.Do("DELETE", c.Endpoint, path, headers, params, []byte(""))
 	if err != nil {
-		beego.Error("Delete application do request error, error is: ", err)
+		c.Logger.Error("Delete application do request error, error is: ", err)
 		return http.StatusInternalServerError, success, err
 	} else if resp.StatusCode == 404 || resp.StatusCode == 410 || resp.StatusCode/100*100 == http.StatusOK {
 		success = true
@@ -326,111 +379,114 @@ func DeleteApp(appId, token string) (status int, success bool, err error) {
 		if err != nil {
 			return resp.StatusCode, success, err
 		}
-		err = errors.New("Delete app error: " + string(body))
+		err = common.NewStatusError("Delete app", resp.StatusCode, body)
 		return resp.StatusCode, success, err
 	}
 }
 
 // 只有真正返回 404 才认为不存在了
-func CheckAppDeleteSuccess(appId, token string) (success bool, err error) {
+func (c *Client) CheckAppDeleteSuccess(appId, token string) (success bool, err error) {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	params := make(map[string]string)
 	path := APP_ROUTER_PREFIX + "/" + appId
-	resp, err := http_client.DoHTTPrequest("GET", endpoint, path, headers, params, []byte(""))
+	resp, err := c.HTTP.Do("GET", c.Endpoint, path, headers, params, []byte(""))
 	if err != nil {
-		beego.Error("Check app delete status do request error, error is: ", err)
+		c.Logger.Error("Check app delete status do request error, error is: ", err)
 		return false, err
 	}
 	http_client.CloseResponseBody(resp)
 	if resp.StatusCode == http.StatusNotFound {
-		beego.Info("App " + appId + " delete success")
+		c.Logger.Info("App " + appId + " delete success")
 		return true, nil
 	} else {
-		err = errors.New("App " + appId + " still exists")
+		err = common.NewError(common.KindInternal, "Check app delete", "App "+appId+" still exists")
 		return false, err
 	}
 }
 
 // 根据编排接口获取节点信息，返回错误码和错误信息
-func GetNodeId(appId, token string) (nodeId string, err error) {
-	nodeSet, err := GetNodeIds(appId, token)
+func (c *Client) GetNodeId(appId, token string) (nodeId string, err error) {
+	nodeSet, err := c.GetNodeIds(appId, token)
 	if nil != err {
-		beego.Error("GetNodeIds error, error is: ", err)
+		c.Logger.Error("GetNodeIds error, error is: ", err)
 		return "", err
 	}
 	if len(nodeSet) > 0 {
 		return nodeSet[0].NodeId, nil
 	}
-	return "", errors.New("get application nodeid")
+	return "", common.NewError(common.KindInternal, "Get application nodeid", "no node found")
 }
-func GetNodeIds(appId, token string) (nodeSet []AppNodeInfo, err error) {
+func (c *Client) GetNodeIds(appId, token string) (nodeSet []AppNodeInfo, err error) {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	params := map[string]string{"node_type": AOS_BLUEPRINT_NODETYPE}
 	path := APP_ROUTER_PREFIX + "/" + appId + "/nodes"
-	resp, err := http_client.DoHTTPrequest("GET", endpoint, path, headers, params, []byte(""))
+	resp, err := c.HTTP.Do("GET", c.Endpoint, path, headers, params, []byte(""))
 	if nil != err {
-		beego.Error("Get application nodeId error, error is: ", err)
+		c.Logger.Error("Get application nodeId error, error is: ", err)
 		return nil, err
 	}
 	if http_client.IsResponseStatusOk(resp) {
 		respBody, err := http_client.CopyResponseBody(resp)
-		beego.Info("response of get nodes: ", resp.StatusCode, string(respBody))
+		c.Logger.Info("response of get nodes: ", resp.StatusCode, string(respBody))
 		if err != nil {
-			return nil, errors.New("fail to get node: " + err.Error())
+			return nil, common.WrapError("Get node", err)
 		}
 		err = json.Unmarshal([]byte(respBody), &nodeSet)
 		if err != nil {
-			return nil, errors.New("fail to unmarshal node response body: " + err.Error())
+			return nil, common.WrapError("Unmarshal node response body", err)
 		}
 		return nodeSet, nil
 	}
-	return nil, errors.New("invalid response(do request to get application nodeids): " + strconv.Itoa(resp.StatusCode))
+	respBody, _ := http_client.CopyResponseBody(resp)
+	return nil, common.NewStatusError("Get application nodeids", resp.StatusCode, respBody)
 }
-func GetEnv(appId, nodeId, token string) (envBody SetEnvbody, err error) {
+func (c *Client) GetEnv(appId, nodeId, token string) (envBody SetEnvbody, err error) {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	var path string
 	if nodeId == "" {
-		return envBody, errors.New("temporarily not support for nodeGuid is empty")
+		return envBody, common.NewError(common.KindBadRequest, "Get env", "temporarily not support for nodeGuid is empty")
 	}
 	if nodeId != "" {
 		path = APP_ROUTER_PREFIX + "/" + appId + "/nodes/" + nodeId + "/properties"
 	}
-	return queryBindEnv(appId, nodeId, path, token)
+	envBody, _, err = c.queryBindEnv(appId, nodeId, path, token)
+	return envBody, err
 }
 
 // 调用编排接口获取现有的环境变量: 内部使用
-func queryBindEnv(appId string, nodeId string, path string, token string) (SetEnvbody, error) {
+// 返回 env 以及响应中的 ETag(可能为空)
+func (c *Client) queryBindEnv(appId string, nodeId string, path string, token string) (SetEnvbody, string, error) {
 	var envBody SetEnvbody
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
-	resp, err := http_client.DoHTTPrequest("GET", "", "", nil, nil, nil)
+	resp, err := c.HTTP.Do("GET", c.Endpoint, path, headers, nil, nil)
 	if err != nil {
-		return envBody, errors.New("do request to get env error: " + err.Error())
+		return envBody, "", common.WrapError("Do request to get env", err)
 	}
 	if http_client.IsResponseStatusOk(resp) {
 		respBody, err := http_client.CopyResponseBody(resp)
-		beego.Info("response of get env: ", resp.StatusCode, string(respBody), len(respBody))
+		c.Logger.Info("response of get env: ", resp.StatusCode, string(respBody), len(respBody))
 		if err != nil {
-			return envBody, errors.New("fail to get env response body: " + err.Error())
+			return envBody, "", common.WrapError("Get env response body", err)
 		}
 		if len(respBody) > 0 {
 			err = json.Unmarshal(respBody, &envBody)
 			if err != nil {
-				return envBody, errors.New("fail to unmarshal env response body: " + err.Error())
+				return envBody, "", common.WrapError("Unmarshal env response body", err)
 			}
 		}
 	} else {
 		statusCode := strconv.Itoa(resp.StatusCode)
 		respBody, err := http_client.CopyResponseBody(resp)
 		if err != nil {
-			beego.Error("invalid response(do request to get env), status code: ", statusCode, " copy respnse body error:", err)
+			c.Logger.Error("invalid response(do request to get env), status code: ", statusCode, " copy respnse body error:", err)
 		}
-		return envBody, errors.New("invalid response(do request to get env), status code: " + statusCode + " response body :" + string(respBody))
+		return envBody, "", common.NewStatusError("Get env", resp.StatusCode, respBody)
 	}
-	return envBody, nil
+	return envBody, resp.Header.Get("ETag"), nil
 }
 func searchInstName(instancesEnv []EnvSetEntity, instName string) int {
 	if len(instancesEnv) > 0 {
@@ -482,32 +538,56 @@ func modifyBindEnv(serviceName string, envBody SetEnvbody, envItem EnvSetEntity,
 	}
 	return envBody
 }
-func SetCallerEnv(appId string, nodeId string, serviceName string, envItem EnvSetEntity, token string, mode string) error {
+
+// 读取节点 env, 修改 BIND_SERVICES 后写回.
+// 同一节点在 broker 内加锁串行; AOS 返回 ETag 或 resource_version 时写回带上版本, 冲突(409/412)后重新读取并重试
+func (c *Client) SetCallerEnv(appId string, nodeId string, serviceName string, envItem EnvSetEntity, token string, mode string) error {
 	path := APP_ROUTER_PREFIX + "/" + appId + "/properties"
 	if nodeId != "" {
 		path = APP_ROUTER_PREFIX + "/" + appId + "/nodes/" + nodeId + "/properties"
 	}
 	if nodeId == "" {
-		return errors.New("temporarily not support for nodeGuid is empty")
+		return common.NewError(common.KindBadRequest, "Set caller env", "temporarily not support for nodeGuid is empty")
 	}
-	beego.Info("endpoint:", endpoint, "path:", path, "appId", appId, "nodeId:", nodeId)
+	c.Logger.Info("endpoint:", c.Endpoint, "path:", path, "appId", appId, "nodeId:", nodeId)
+	unlock := envLocks.Lock(c.Endpoint + "/" + appId + "/" + nodeId)
+	defer unlock()
+
+	var err error
+	for i := 0; i <= ENV_UPDATE_MAX_RETRIES; i++ {
+		if i > 0 {
+			c.Logger.Warn("env of app "+appId+" modified concurrently, retry ", i, ": ", err)
+			time.Sleep(time.Duration(i) * ENV_UPDATE_RETRY_DELAY)
+		}
+		err = c.putCallerEnv(appId, nodeId, path, serviceName, envItem, token, mode)
+		if !isVersionConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) putCallerEnv(appId string, nodeId string, path string, serviceName string, envItem EnvSetEntity, token string, mode string) error {
 	// 查询环境变量
-	envBody, err := queryBindEnv(appId, nodeId, path, token)
+	envBody, etag, err := c.queryBindEnv(appId, nodeId, path, token)
 	if err != nil {
 		return err
 	}
 	// 	调整环境变量并调用cfe接口
 	envBody = modifyBindEnv(serviceName, envBody, envItem, mode)
 	modifiedEnvBody, err := json.Marshal(envBody)
-	beego.Info("envBody:", envBody, "modifiedEnvBody:", string(modifiedEnvBody))
+	c.Logger.Info("envBody:", envBody, "modifiedEnvBody:", string(modifiedEnvBody))
 	if err != nil {
-		return errors.New("fail to marshal modified env: " + err.Error())
+		return common.WrapError("Marshal modified env", err)
 	}
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
-	resp, err := http_client.DoHTTPrequest("PUT", "", "", nil, nil, nil)
+	if etag != "" {
+		headers["If-Match"] = etag
+	}
+	resp, err := c.HTTP.Do("PUT", c.Endpoint, path, headers, nil, modifiedEnvBody)
 	if err != nil {
-		return errors.New("do request to put env error: " + err.Error())
+		return common.WrapError("Do request to put env", err)
 	}
 	if http_client.IsResponseStatusOk(resp) {
 		http_client.CloseResponseBody(resp)
@@ -515,60 +595,107 @@ func SetCallerEnv(appId string, nodeId string, serviceName string, envItem EnvSe
 		statusCode := strconv.Itoa(resp.StatusCode)
 		respBody, err := http_client.CopyResponseBody(resp)
 		if err != nil {
-			beego.Error("fail to put env response body, status code: ", statusCode, " copy respnse body error:", err)
+			c.Logger.Error("fail to put env response body, status code: ", statusCode, " copy respnse body error:", err)
 		}
-		return errors.New("fail to put env response body, status code:" + statusCode + "response body :" + string(respBody))
+		return common.NewStatusError("Put env", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// 写回 env 时版本冲突, 需要重新读取后重试
+func isVersionConflict(err error) bool {
+	var e *common.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed
+}
+
+// 在使用方应用的 BIND_SERVICES 环境变量中添加(MODE_ADD_OPERATE)或删除(MODE_DEL_OPERATE)服务实例, 然后触发 reconfigure 使其生效
+func (c *Client) ModifyBindServices(appId, serviceName string, envItem EnvSetEntity, token, mode string) error {
+	nodeId, err := c.GetNodeId(appId, token)
+	if err != nil {
+		c.Logger.Error("Get node of app "+appId+" error: ", err)
+		return err
+	}
+	if err = c.SetCallerEnv(appId, nodeId, serviceName, envItem, token, mode); err != nil {
+		c.Logger.Error("Set BIND_SERVICES of app "+appId+" error: ", err)
+		return err
+	}
+	if err = c.Reconfigure(appId, token); err != nil {
+		c.Logger.Error("Reconfigure app "+appId+" error: ", err)
+		return err
 	}
 	return nil
 }
-func GetDashboardUrl(appId string, token string) (url string, err error) {
-	nodeId, err := GetNodeId(appId, token)
+
+func (c *Client) GetDashboardUrl(appId string, token string) (url string, err error) {
+	nodeId, err := c.GetNodeId(appId, token)
 	if err != nil {
-		beego.Error("Do request GetNodeId error: ", err)
+		c.Logger.Error("Do request GetNodeId error: ", err)
 		return "", err
 	}
-	beego.Info("nodeId:", nodeId)
-	_, hostIp, err := QueryAppIp(appId, nodeId, token)
+	c.Logger.Info("nodeId:", nodeId)
+	_, hostIp, err := c.QueryAppIp(appId, nodeId, token)
 	if err != nil {
-		beego.Error("Do QueryAppIp error: ", err)
+		c.Logger.Error("Do QueryAppIp error: ", err)
 		return "", err
 	}
 	// 通过获取node得到的port是创建时的port，更新实例后的port会改变因此通过output获取port，临时规避--by wxy
-	outputs, err := GetBlueprintOutput(appId, token)
-	if port, ok := outputs["address_port"].(string); ok {
-		url = hostIp + ":" + port
-		beego.Info("port:", port)
-	} else {
-		url = hostIp + ":" + strconv.Itoa(outputs["address_port"].(int))
+	outputs, err := c.GetBlueprintOutput(appId, token)
+	if err != nil {
+		c.Logger.Error("Do GetBlueprintOutput error: ", err)
+		return "", err
+	}
+	port, ok := portString(outputs["address_port"])
+	if !ok {
+		return "", common.NewError(common.KindInternal, "Get dashboard url", "invalid address_port in outputs of app "+appId)
 	}
+	c.Logger.Info("port:", port)
+	url = hostIp + ":" + port
 	// url = hostIp + ":" + strconv.Itoa(port)
-	beego.Info("url:", url)
+	c.Logger.Info("url:", url)
 	return url, nil
 }
-func GetBlueprintOutput(appId string, token string) (map[string]interface{}, error) {
+
+// blueprint outputs 中的端口可能是字符串或数字
+func portString(v interface{}) (string, bool) {
+	switch port := v.(type) {
+	case string:
+		return port, port != ""
+	case float64:
+		return strconv.FormatInt(int64(port), 10), true
+	case json.Number:
+		return port.String(), true
+	case int:
+		return strconv.Itoa(port), true
+	}
+	return "", false
+}
+func (c *Client) GetBlueprintOutput(appId string, token string) (map[string]interface{}, error) {
 	path := APP_ROUTER_PREFIX + "/" + appId + "/outputs"
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
-	resp, err := http_client.DoHTTPrequest("GET", endpoint, path, headers, nil, nil)
+	resp, err := c.HTTP.Do("GET", c.Endpoint, path, headers, nil, nil)
 	if err != nil {
-		beego.Error("Do request (get blueprint output) error: ", err)
+		c.Logger.Error("Do request (get blueprint output) error: ", err)
 		return nil, err
 	}
 	respBody, err := http_client.CopyResponseBody(resp)
 	if err != nil {
-		beego.Error("Read response body (get blueprint output) error: ", err)
+		c.Logger.Error("Read response body (get blueprint output) error: ", err)
 		return nil, err
 	}
 	// 检查返回结果是否正常
 	if !http_client.IsResponseStatusOk(resp) {
-		err = errors.New("Response status code (get blueprint output) invalid: " + string(respBody))
+		err = common.NewStatusError("Get blueprint output", resp.StatusCode, respBody)
 		return nil, err
 	}
 	var outputs Outputs
 	err = json.Unmarshal(respBody, &outputs)
-	beego.Info("outputs:", outputs)
+	c.Logger.Info("outputs:", outputs)
 	if err != nil {
-		beego.Error("Unmarshall blueprint's output error: ", err)
+		c.Logger.Error("Unmarshall blueprint's output error: ", err)
 		return nil, err
 	}
 	// 数据转换	map[string]Output to map[string][string], 其中 Output 的 description 信息会丢弃掉.
@@ -578,80 +705,84 @@ func GetBlueprintOutput(appId string, token string) (map[string]interface{}, err
 	}
 	return dest, nil
 }
-func QueryAppIp(appId, nodeId, token string) (port int, hostIp string, err error) {
+func (c *Client) QueryAppIp(appId, nodeId, token string) (port int, hostIp string, err error) {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	params := make(map[string]string)
 	path := APP_ROUTER_PREFIX + "/" + appId + "/nodes/" + nodeId
 	var nodeResp AppNodeResp
-	resp, err := http_client.DoHTTPrequest("GET", endpoint, path, headers, params, []byte(""))
+	resp, err := c.HTTP.Do("GET", c.Endpoint, path, headers, params, []byte(""))
 	if err != nil {
-		beego.Error("Query App Host IP do request error, error is: ", err)
+		c.Logger.Error("Query App Host IP do request error, error is: ", err)
 		return
 	}
 	nodeRespBody, err := http_client.CopyResponseBody(resp)
 	if err != nil {
-		beego.Error("Query App Host IP copy response body error, error is: ", err)
+		c.Logger.Error("Query App Host IP copy response body error, error is: ", err)
 		return
 	}
 	if !http_client.IsResponseStatusOk(resp) {
-		err = errors.New("Create app host ip from cfe error: " + string(nodeRespBody))
+		err = common.NewStatusError("Query app host ip", resp.StatusCode, nodeRespBody)
 		return
 	}
 	err = json.Unmarshal(nodeRespBody, &nodeResp)
 	if err != nil {
-		beego.Error("Query App Host IP unmarshal response body error, error is: ", err)
+		c.Logger.Error("Query App Host IP unmarshal response body error, error is: ", err)
 		return
 	}
-	beego.Debug("the ans is : ", nodeResp)
+	c.Logger.Debug("the ans is : ", nodeResp)
 	var service map[string]interface{}
-	if nil != nodeResp.RuntimeProperties["Service"] {
-		service = nodeResp.RuntimeProperties["Service"].(map[string]interface{})
+	if s, ok := nodeResp.RuntimeProperties["Service"].(map[string]interface{}); ok {
+		service = s
 	} else {
-		beego.Error("The service info is:", nodeResp.RuntimeProperties["Service"], "  error:", err)
-		err = errors.New("The service info is nil")
+		c.Logger.Error("The service info is:", nodeResp.RuntimeProperties["Service"], "  error:", err)
+		err = common.NewError(common.KindInternal, "Query app host ip", "The service info is nil")
 		return
 	}
 	// 获取app的port
-	beego.Debug("The servicePort is:", service["ports"])
-	servicePort := service["ports"].([]interface{})
+	c.Logger.Debug("The servicePort is:", service["ports"])
+	servicePort, _ := service["ports"].([]interface{})
 	var nodePort map[string]interface{}
 	if len(servicePort) > 0 {
-		nodePort = servicePort[0].(map[string]interface{})
-	} else {
-		err = errors.New("servicePort Ports is null")
+		nodePort, _ = servicePort[0].(map[string]interface{})
+	}
+	if nodePort == nil {
+		err = common.NewError(common.KindInternal, "Query app host ip", "servicePort Ports is null")
 		return
 	}
-	beego.Debug("The nodePort is:", nodePort)
-	port = int(nodePort["nodePort"].(float64))
+	c.Logger.Debug("The nodePort is:", nodePort)
+	if p, ok := nodePort["nodePort"].(float64); ok {
+		port = int(p)
+	}
 	if len(nodeResp.Instances.Items) > 0 {
 		hostIp = nodeResp.Instances.Items[0].Status.HostIp
 		return
 	} else {
-		err = errors.New("App node format is illegal")
+		err = common.NewError(common.KindInternal, "Query app host ip", "App node format is illegal")
 		return
 	}
 }
-func Reconfigure(appId string, token string) error {
+func (c *Client) Reconfigure(appId string, token string) error {
 	headers := make(map[string]string)
 	headers["X-Auth-Token"] = token
 	path := APP_ROUTER_PREFIX + "/" + appId + "/actions"
 	bodyMap := make(map[string]interface{})
 	bodyMap["lifecycle"] = "reconfigure"
-	data, _ := json.Marshal(bodyMap)
-	fmt.Sprintln(path, data)
-
-	resp, err := http_client.DoHTTPrequest("PUT", "", "", nil, nil, nil)
+	data, err := json.Marshal(bodyMap)
+	if err != nil {
+		return common.WrapError("Marshal reconfigure request body", err)
+	}
+	resp, err := c.HTTP.Do("PUT", c.Endpoint, path, headers, nil, data)
 	if err != nil {
-		return errors.New("do request (put reconfigure) error: " + err.Error())
+		return common.WrapError("Do request (put reconfigure)", err)
 	}
 	respBody, err := http_client.CopyResponseBody(resp)
 	if err != nil {
-		beego.Error("Read response body (put reconfigure) error: ", err)
+		c.Logger.Error("Read response body (put reconfigure) error: ", err)
 		return err
 	}
 	if !http_client.IsResponseStatusOk(resp) {
-		return errors.New("Response status code (put reconfigure) is invalid: " + string(respBody))
+		return common.NewStatusError("Put reconfigure", resp.StatusCode, respBody)
 	}
 	return nil
 }
@@ -0,0 +1,59 @@
+package aos
+
+import (
+	"errors"
+
+	"github.com/astaxie/beego"
+	http_client "service-broker/rest"
+)
+
+// 日志接口, 默认输出到 beego 日志
+type Logger interface {
+	Debug(v ...interface{})
+	Info(v ...interface{})
+	Warn(v ...interface{})
+	Error(v ...interface{})
+}
+
+type beegoLogger struct{}
+
+func (beegoLogger) Debug(v ...interface{}) { beego.Debug(v...) }
+func (beegoLogger) Info(v ...interface{})  { beego.Info(v...) }
+func (beegoLogger) Warn(v ...interface{})  { beego.Warn(v...) }
+func (beegoLogger) Error(v ...interface{}) { beego.Error(v...) }
+
+// 访问一个 AOS 的客户端, 不同的 Client 可以指向不同的 AOS
+type Client struct {
+	Endpoint string              // AOS的地址
+	HTTP     *http_client.Client // 超时、TLS 等传输层参数
+	Logger   Logger
+}
+
+// httpClient 为 nil 时使用 rest 包的默认客户端, logger 为 nil 时使用 beego 日志
+func NewClient(endpoint string, httpClient *http_client.Client, logger Logger) *Client {
+	if httpClient == nil {
+		httpClient = http_client.DefaultClient()
+	}
+	if logger == nil {
+		logger = beegoLogger{}
+	}
+	return &Client{
+		Endpoint: endpoint,
+		HTTP:     httpClient,
+		Logger:   logger,
+	}
+}
+
+// 从 app.conf 读取 AOS 地址及传输层参数, prefix 为 "aos_" 时读取 aos_endpoint, aos_connect_timeout, aos_request_timeout, aos_tls_*
+func NewClientFromConfig(prefix string) (*Client, error) {
+	endpoint := beego.AppConfig.String(prefix + "endpoint")
+	if endpoint == "" {
+		return nil, errors.New(prefix + "endpoint is not configured")
+	}
+	httpClient, err := http_client.NewClientFromConfig(prefix)
+	if err != nil {
+		return nil, err
+	}
+	beego.Info("endpoint: ", endpoint)
+	return NewClient(endpoint, httpClient, nil), nil
+}
@@ -0,0 +1,115 @@
+package aos_test
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	"service-broker/aos"
+	"service-broker/aostest"
+)
+
+const (
+	testToken   = "token"
+	testService = "redis"
+)
+
+// 节点上 BIND_SERVICES 中 service 的条目名称
+func bindNames(t *testing.T, s *aostest.Server, appId string) map[string]bool {
+	t.Helper()
+	stack, ok := s.Stack(appId)
+	if !ok {
+		t.Fatal("app " + appId + " not found")
+	}
+	var body aos.SetEnvbody
+	if err := json.Unmarshal(stack.Nodes[0].Properties, &body); err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, entry := range body.BindEnv.BindServices[testService] {
+		names[entry.Name] = true
+	}
+	return names
+}
+
+// 并发写同一节点时, 每个绑定都应保留在 BIND_SERVICES 中
+func TestSetCallerEnvConcurrent(t *testing.T) {
+	s := aostest.NewServer()
+	defer s.Close()
+	stack := s.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	nodeId := stack.Nodes[0].Id
+	client := s.Client()
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			entry := aos.EnvSetEntity{Name: "binding-" + strconv.Itoa(i), Label: testService}
+			errs <- client.SetCallerEnv(stack.Id, nodeId, testService, entry, testToken, aos.MODE_ADD_OPERATE)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	names := bindNames(t, s, stack.Id)
+	for i := 0; i < n; i++ {
+		if name := "binding-" + strconv.Itoa(i); !names[name] {
+			t.Errorf("%s lost from BIND_SERVICES", name)
+		}
+	}
+
+	//并发删除一半, 另一半保留
+	var del sync.WaitGroup
+	for i := 0; i < n; i += 2 {
+		del.Add(1)
+		go func(i int) {
+			defer del.Done()
+			entry := aos.EnvSetEntity{Name: "binding-" + strconv.Itoa(i)}
+			if err := client.SetCallerEnv(stack.Id, nodeId, testService, entry, testToken, aos.MODE_DEL_OPERATE); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	del.Wait()
+	names = bindNames(t, s, stack.Id)
+	for i := 0; i < n; i++ {
+		if name := "binding-" + strconv.Itoa(i); names[name] != (i%2 == 1) {
+			t.Errorf("%s in BIND_SERVICES: %v", name, names[name])
+		}
+	}
+}
+
+// 其它写入者在读和写之间修改了节点时, 412 后重新读取并保留对方的修改
+func TestSetCallerEnvRetriesOnConflict(t *testing.T) {
+	s := aostest.NewServer()
+	defer s.Close()
+	stack := s.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	nodeId := stack.Nodes[0].Id
+	client := s.Client()
+
+	s.Inject(aostest.Failure{Op: aostest.OP_PUT_PROPERTIES, StatusCode: 412, Times: 1})
+	entry := aos.EnvSetEntity{Name: "binding-1", Label: testService}
+	if err := client.SetCallerEnv(stack.Id, nodeId, testService, entry, testToken, aos.MODE_ADD_OPERATE); err != nil {
+		t.Fatal(err)
+	}
+	if names := bindNames(t, s, stack.Id); !names["binding-1"] {
+		t.Errorf("BIND_SERVICES = %v", names)
+	}
+	var puts int
+	for _, req := range s.Requests() {
+		if req.Op == aostest.OP_PUT_PROPERTIES {
+			puts++
+		}
+	}
+	if puts != 2 {
+		t.Errorf("PUT properties %d times, want 2", puts)
+	}
+}
@@ -0,0 +1,139 @@
+package aos
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+const (
+	STACK_NAME_HASH_LENGTH = 10 // 名称中哈希部分的长度, base32 每个字符 5 bit
+)
+
+// 小写 base32, 只包含 a-z 和 2-7
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// 生成 stack 名称: <prefix>-<service 名称>-<instance id 的哈希>.
+// 哈希基于完整的 instance id, 不同实例的名称不会因截断而相同; 名称只包含 AOS 允许的 [a-z0-9-],
+// 以字母开头, 不以 '-' 结尾, 长度不超过 APP_NAME_MAX_LENGTH. prefix 过长时截断, service 名称按剩余长度截断或省略.
+func GetStackName(prefix string, serviceName string, instanceId string) string {
+	hash := nameHash(instanceId)
+	head := stackNamePrefix(prefix)
+	// service 名称可用的长度: 去掉哈希、prefix 和各自的 '-'
+	room := APP_NAME_MAX_LENGTH - len(hash) - 1
+	if head != "" {
+		room -= len(head) + 1
+	}
+	service := sanitizeName(serviceName)
+	if head == "" {
+		service = startWithLetter(service)
+	}
+	if service = truncateName(service, room); service != "" {
+		head = joinName(head, service)
+	}
+	return startWithLetter(joinName(head, hash))
+}
+
+// name 是否符合 GetStackName(prefix, ...) 生成的格式: <prefix>-[<service>-]<哈希>
+func IsStackName(prefix, name string) bool {
+	head := stackNamePrefix(prefix)
+	if head == "" || len(name) > APP_NAME_MAX_LENGTH || !strings.HasPrefix(name, head+"-") {
+		return false
+	}
+	rest := name[len(head)+1:]
+	if len(rest) < STACK_NAME_HASH_LENGTH {
+		return false
+	}
+	hash := rest[len(rest)-STACK_NAME_HASH_LENGTH:]
+	for i := 0; i < len(hash); i++ {
+		if !(hash[i] >= 'a' && hash[i] <= 'z') && !(hash[i] >= '2' && hash[i] <= '7') {
+			return false
+		}
+	}
+	if len(rest) == STACK_NAME_HASH_LENGTH {
+		return true
+	}
+	service := rest[:len(rest)-STACK_NAME_HASH_LENGTH]
+	if len(service) < 2 || service[len(service)-1] != '-' {
+		return false
+	}
+	service = service[:len(service)-1]
+	return sanitizeName(service) == service
+}
+
+// 升级前的 stack 名称: <prefix>-<instance_name 前 12 个字符>-<instance id 前 5 个字符>.
+// 只用于接管升级前开始创建、尚未记录的 stack, 不同实例可能得到相同的名称
+func LegacyStackName(prefix string, instanceName string, instanceId string) string {
+	if len(instanceName) > 12 {
+		instanceName = instanceName[0:12]
+	}
+	if len(instanceId) > 5 {
+		instanceId = instanceId[0:5]
+	}
+	return strings.TrimRight(prefix+"-"+instanceName+"-"+instanceId, "-")
+}
+
+// 名称中的 prefix 部分, 至少为哈希留出位置
+func stackNamePrefix(prefix string) string {
+	return truncateName(startWithLetter(sanitizeName(prefix)), APP_NAME_MAX_LENGTH-STACK_NAME_HASH_LENGTH-1)
+}
+
+// 把名称转换为 AOS 允许的字符集, 超长时截断并追加完整名称的哈希, 保证不同的名称截断后仍不相同
+func GetAppFinalName(appName string) string {
+	name := startWithLetter(sanitizeName(appName))
+	if len(name) > APP_NAME_MAX_LENGTH || name != appName {
+		hash := nameHash(appName)
+		name = joinName(truncateName(name, APP_NAME_MAX_LENGTH-len(hash)-1), hash)
+	}
+	return startWithLetter(name)
+}
+
+func nameHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return nameEncoding.EncodeToString(sum[:])[:STACK_NAME_HASH_LENGTH]
+}
+
+// 转为小写, 其它字符替换为 '-', 合并连续的 '-' 并去掉首尾的 '-'
+func sanitizeName(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
+
+// 按字节截断(sanitizeName 之后只有 ASCII), 并去掉结尾的 '-'
+func truncateName(s string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return strings.TrimRight(s, "-")
+}
+
+func joinName(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "-" + b
+}
+
+// 名称以数字开头时在前面加上 'n'
+func startWithLetter(name string) string {
+	if name == "" || (name[0] >= 'a' && name[0] <= 'z') {
+		return name
+	}
+	return "n" + name
+}
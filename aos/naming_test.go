@@ -0,0 +1,112 @@
+package aos
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+var validName = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]$`)
+
+func checkName(t *testing.T, name string) bool {
+	if len(name) > APP_NAME_MAX_LENGTH || !validName.MatchString(name) || strings.Contains(name, "--") {
+		t.Logf("invalid name %q", name)
+		return false
+	}
+	return true
+}
+
+func TestGetStackNameIsValid(t *testing.T) {
+	f := func(prefix, serviceName, instanceId string) bool {
+		return checkName(t, GetStackName(prefix, serviceName, instanceId))
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetStackNameLongPrefix(t *testing.T) {
+	for _, prefix := range []string{"abcdefghi", "abcdefghijklmnopqrstuvwxyz", "9-prefix-with-digits"} {
+		name := GetStackName(prefix, "redis", "instance-1")
+		if !checkName(t, name) {
+			t.Errorf("GetStackName(%q) = %q", prefix, name)
+		}
+		if !IsStackName(prefix, name) {
+			t.Errorf("IsStackName(%q, %q) = false", prefix, name)
+		}
+	}
+}
+
+func TestGetStackNameUsesAllRoom(t *testing.T) {
+	name := GetStackName(INSTANCE_STACK_PREFIX, "redis-cluster", "instance-1")
+	if len(name) != APP_NAME_MAX_LENGTH {
+		t.Errorf("len(%q) = %d, want %d", name, len(name), APP_NAME_MAX_LENGTH)
+	}
+}
+
+func TestGetStackNameDistinctForSharedPrefix(t *testing.T) {
+	f := func(id string, a, b uint16) bool {
+		if a == b {
+			return true
+		}
+		x := GetStackName(INSTANCE_STACK_PREFIX, "redis", id+strconv.Itoa(int(a)))
+		y := GetStackName(INSTANCE_STACK_PREFIX, "redis", id+strconv.Itoa(int(b)))
+		return x != y
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+	const id = "5b1a7c1e-6a3f-4b0a-9a6e-3c2f5e1d0a01"
+	if GetStackName(INSTANCE_STACK_PREFIX, "redis", id) == GetStackName(INSTANCE_STACK_PREFIX, "redis", id+"-2") {
+		t.Error("ids sharing a prefix produce the same name")
+	}
+}
+
+func TestGetStackNameDeterministic(t *testing.T) {
+	f := func(serviceName, instanceId string) bool {
+		return GetStackName(INSTANCE_STACK_PREFIX, serviceName, instanceId) == GetStackName(INSTANCE_STACK_PREFIX, serviceName, instanceId)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetAppFinalNameIsValid(t *testing.T) {
+	f := func(appName string) bool {
+		name := GetAppFinalName(appName)
+		return name == "" || checkName(t, name)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsStackName(t *testing.T) {
+	f := func(serviceName, instanceId string) bool {
+		return IsStackName(INSTANCE_STACK_PREFIX, GetStackName(INSTANCE_STACK_PREFIX, serviceName, instanceId))
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"i-love-redis", "i-redis", "redis-abcdefghij", "i-redis-abcdefgh01", "i--abcdefghij", "i-redis-cluster-abcdefghij"} {
+		if IsStackName(INSTANCE_STACK_PREFIX, name) {
+			t.Errorf("IsStackName(%q) = true", name)
+		}
+	}
+}
+
+func TestLegacyStackName(t *testing.T) {
+	cases := []struct{ instanceName, instanceId, want string }{
+		{"redis", "5b1a7c1e-6a3f", "i-redis-5b1a7"},
+		{"a-very-long-instance-name", "abc", "i-a-very-long--abc"},
+		{"", "5b1a7c1e", "i--5b1a7"},
+		{"redis", "", "i-redis"},
+	}
+	for _, c := range cases {
+		if got := LegacyStackName(INSTANCE_STACK_PREFIX, c.instanceName, c.instanceId); got != c.want {
+			t.Errorf("LegacyStackName(%q, %q) = %q, want %q", c.instanceName, c.instanceId, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package aos
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	DEFAULT_REGION     = "default"
+	REGION_PARAMETER   = "region" // CreateInstReq.Parameters 与 OSB context 中指定区域的字段
+	USERDATA_SEPARATOR = ":"      // userdata 中区域与 AOS app id 的分隔符
+)
+
+// 一个 AOS 区域: 地址和访问凭据
+type Region struct {
+	Name      string
+	Client    *Client
+	ProjectId string   // 非空时替代请求中的 space_guid 作为 AOS 的 project_id
+	Token     string   // 后台跟踪、对账等没有请求 token 时访问该区域使用的 token
+	UseToken  bool     // 为 true 时 Token 也替代平台请求头中的 X-Auth-Token, 要求 broker 开启 basic auth
+	Plans     []string // 固定部署到该区域的 plan id
+}
+
+// 访问该区域使用的 token: 默认使用平台请求中的 token, 没有时使用区域配置的 token
+func (r *Region) AuthToken(reqToken string) string {
+	if r.Token != "" && (r.UseToken || reqToken == "") {
+		return r.Token
+	}
+	return reqToken
+}
+
+// 在该区域创建 stack 时使用的 project_id
+func (r *Region) Project(spaceGuid string) string {
+	if r.ProjectId != "" {
+		return r.ProjectId
+	}
+	return spaceGuid
+}
+
+// 区域注册表, 根据 plan id、请求参数或 OSB context 选择区域
+type Registry struct {
+	regions     map[string]*Region
+	defaultName string
+	planRegions map[string]string
+}
+
+func NewRegistry(defaultName string, regions ...*Region) (*Registry, error) {
+	registry := &Registry{
+		regions:     make(map[string]*Region),
+		defaultName: defaultName,
+		planRegions: make(map[string]string),
+	}
+	for _, region := range regions {
+		if strings.Contains(region.Name, USERDATA_SEPARATOR) {
+			return nil, errors.New("region name must not contain '" + USERDATA_SEPARATOR + "': " + region.Name)
+		}
+		if _, ok := registry.regions[region.Name]; ok {
+			return nil, errors.New("duplicate region: " + region.Name)
+		}
+		registry.regions[region.Name] = region
+		for _, planId := range region.Plans {
+			if other, ok := registry.planRegions[planId]; ok {
+				return nil, errors.New("plan " + planId + " is bound to both region " + other + " and " + region.Name)
+			}
+			registry.planRegions[planId] = region.Name
+		}
+	}
+	if _, ok := registry.regions[defaultName]; !ok {
+		return nil, errors.New("default region not found: " + defaultName)
+	}
+	return registry, nil
+}
+
+// 从 app.conf 读取区域配置:
+//
+//	aos_regions = cn-north-1;cn-south-1
+//	aos_default_region = cn-north-1
+//	[cn-north-1]
+//	aos_endpoint = https://aos.cn-north-1.example.com
+//	aos_project_id = xxx
+//	aos_token = xxx
+//	aos_use_token = false
+//	aos_plans = plan-id-1;plan-id-2
+//	aos_tls_ca_file = ...
+//
+// 未配置 aos_regions 时, 使用顶层的 aos_endpoint 等配置作为唯一的 default 区域.
+func NewRegistryFromConfig() (*Registry, error) {
+	names := beego.AppConfig.Strings("aos_regions")
+	if len(names) == 0 {
+		region, err := loadRegion(DEFAULT_REGION, "aos_")
+		if err != nil {
+			return nil, err
+		}
+		return NewRegistry(DEFAULT_REGION, region)
+	}
+	var regions []*Region
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		region, err := loadRegion(name, name+"::aos_")
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	defaultName := beego.AppConfig.DefaultString("aos_default_region", regions[0].Name)
+	return NewRegistry(defaultName, regions...)
+}
+
+func loadRegion(name, prefix string) (*Region, error) {
+	client, err := NewClientFromConfig(prefix)
+	if err != nil {
+		return nil, errors.New("load region " + name + " error: " + err.Error())
+	}
+	return &Region{
+		Name:      name,
+		Client:    client,
+		ProjectId: beego.AppConfig.String(prefix + "project_id"),
+		Token:     beego.AppConfig.String(prefix + "token"),
+		UseToken:  beego.AppConfig.DefaultBool(prefix+"use_token", false),
+		Plans:     beego.AppConfig.Strings(prefix + "plans"),
+	}, nil
+}
+
+// 按名称查找区域, 名称为空时返回默认区域
+func (r *Registry) Get(name string) (*Region, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	region, ok := r.regions[name]
+	if !ok {
+		return nil, errors.New("unknown region: " + name)
+	}
+	return region, nil
+}
+
+// 使用区域 token 处理平台请求的区域名称
+func (r *Registry) TokenRegions() []string {
+	var names []string
+	for _, region := range r.List() {
+		if region.UseToken && region.Token != "" {
+			names = append(names, region.Name)
+		}
+	}
+	return names
+}
+
+func (r *Registry) Default() *Region {
+	return r.regions[r.defaultName]
+}
+
+// 按名称排序的全部区域
+func (r *Registry) List() []*Region {
+	regions := make([]*Region, 0, len(r.regions))
+	for _, region := range r.regions {
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Name < regions[j].Name })
+	return regions
+}
+
+// 选择新建实例的区域, 优先级: parameters.region > context.region > plan 绑定的区域 > 默认区域.
+// plan 固定在某个区域时, 不允许通过参数指定其它区域.
+func (r *Registry) Select(planId string, parameters, context map[string]interface{}) (*Region, error) {
+	name, _ := parameters[REGION_PARAMETER].(string)
+	if name == "" {
+		name, _ = context[REGION_PARAMETER].(string)
+	}
+	if planRegion, ok := r.planRegions[planId]; ok {
+		if name != "" && name != planRegion {
+			return nil, errors.New("plan " + planId + " is only available in region " + planRegion)
+		}
+		name = planRegion
+	}
+	return r.Get(name)
+}
+
+// 生成返回给平台的 userdata, 平台后续请求会带回, 据此找到实例所在区域; 默认区域只保存 app id 以兼容旧数据
+func (r *Registry) Userdata(regionName, appId string) string {
+	if regionName == "" || regionName == r.defaultName {
+		return appId
+	}
+	return regionName + USERDATA_SEPARATOR + appId
+}
+
+// 从 userdata 中解析区域和 AOS app id
+func (r *Registry) Resolve(userdata string) (*Region, string, error) {
+	idx := strings.Index(userdata, USERDATA_SEPARATOR)
+	if idx < 0 {
+		return r.Default(), userdata, nil
+	}
+	region, err := r.Get(userdata[:idx])
+	if err != nil {
+		return nil, "", err
+	}
+	return region, userdata[idx+1:], nil
+}
+
+// 去掉参数中的 region 字段, 该字段仅供 broker 选择区域, 不传给 AOS
+func WithoutRegion(parameters map[string]interface{}) map[string]interface{} {
+	if _, ok := parameters[REGION_PARAMETER]; !ok {
+		return parameters
+	}
+	inputs := make(map[string]interface{}, len(parameters))
+	for k, v := range parameters {
+		if k != REGION_PARAMETER {
+			inputs[k] = v
+		}
+	}
+	return inputs
+}
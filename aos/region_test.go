@@ -0,0 +1,38 @@
+package aos
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuthToken(t *testing.T) {
+	cases := []struct {
+		region   Region
+		reqToken string
+		want     string
+	}{
+		{Region{}, "caller", "caller"},
+		{Region{Token: "region"}, "caller", "caller"},
+		{Region{Token: "region"}, "", "region"},
+		{Region{Token: "region", UseToken: true}, "caller", "region"},
+		{Region{UseToken: true}, "caller", "caller"},
+	}
+	for _, c := range cases {
+		if got := c.region.AuthToken(c.reqToken); got != c.want {
+			t.Errorf("%+v.AuthToken(%q) = %q, want %q", c.region, c.reqToken, got, c.want)
+		}
+	}
+}
+
+func TestTokenRegions(t *testing.T) {
+	registry, err := NewRegistry("a",
+		&Region{Name: "a", Token: "t"},
+		&Region{Name: "b", Token: "t", UseToken: true},
+		&Region{Name: "c", UseToken: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := registry.TokenRegions(); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("TokenRegions() = %v", names)
+	}
+}
@@ -0,0 +1,151 @@
+package aos_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"service-broker/aos"
+	"service-broker/aostest"
+)
+
+func propertiesPath(appId, nodeId string) string {
+	return aos.APP_ROUTER_PREFIX + "/" + appId + "/nodes/" + nodeId + "/properties"
+}
+
+func checkRequest(t *testing.T, req aostest.Request, method, path string) {
+	t.Helper()
+	if req.Method != method || req.Path != path {
+		t.Errorf("request = %s %s, want %s %s", req.Method, req.Path, method, path)
+	}
+	if req.Token != testToken {
+		t.Errorf("%s %s: X-Auth-Token = %q", req.Method, req.Path, req.Token)
+	}
+	if accept := req.Header.Get("Accept"); accept != "application/json" {
+		t.Errorf("%s %s: Accept = %q", req.Method, req.Path, accept)
+	}
+}
+
+func TestGetEnvRequest(t *testing.T) {
+	s := aostest.NewServer()
+	defer s.Close()
+	stack := s.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	nodeId := stack.Nodes[0].Id
+
+	env, err := s.Client().GetEnv(stack.Id, nodeId, testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env.BindEnv.BindServices) != 0 {
+		t.Errorf("env = %+v", env)
+	}
+	requests := s.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("requests = %+v", requests)
+	}
+	checkRequest(t, requests[0], http.MethodGet, propertiesPath(stack.Id, nodeId))
+	if len(requests[0].Body) != 0 || requests[0].Header.Get("If-Match") != "" {
+		t.Errorf("GET properties: body %q, If-Match %q", requests[0].Body, requests[0].Header.Get("If-Match"))
+	}
+
+	//未指定节点时不发送请求
+	if _, err = s.Client().GetEnv(stack.Id, "", testToken); err == nil {
+		t.Error("GetEnv without node succeeded")
+	}
+	if n := len(s.Requests()); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestGetEnvError(t *testing.T) {
+	s := aostest.NewServer()
+	defer s.Close()
+	stack := s.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	if _, err := s.Client().GetEnv(stack.Id, "missing", testToken); err == nil {
+		t.Error("GetEnv of missing node succeeded")
+	}
+}
+
+// 读取 properties 并带上 ETag 写回, 请求体中保留原有条目
+func TestSetCallerEnvRequests(t *testing.T) {
+	s := aostest.NewServer()
+	defer s.Close()
+	stack := s.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	nodeId := stack.Nodes[0].Id
+	client := s.Client()
+	path := propertiesPath(stack.Id, nodeId)
+
+	first := aos.EnvSetEntity{Name: "binding-1", Label: testService, Plan: "small", Credentials: `{"host":"127.0.0.1"}`}
+	second := aos.EnvSetEntity{Name: "binding-2", Label: testService, Plan: "small"}
+	if err := client.SetCallerEnv(stack.Id, nodeId, testService, first, testToken, aos.MODE_ADD_OPERATE); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetCallerEnv(stack.Id, nodeId, testService, second, testToken, aos.MODE_ADD_OPERATE); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.Requests()
+	if len(requests) != 4 {
+		t.Fatalf("requests = %+v", requests)
+	}
+	for i, etag := range []string{`"v0"`, `"v1"`} {
+		get, put := requests[2*i], requests[2*i+1]
+		checkRequest(t, get, http.MethodGet, path)
+		checkRequest(t, put, http.MethodPut, path)
+		if match := put.Header.Get("If-Match"); match != etag {
+			t.Errorf("PUT %d: If-Match = %q, want %q", i, match, etag)
+		}
+		if contentType := put.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("PUT %d: Content-Type = %q", i, contentType)
+		}
+	}
+
+	var body aos.SetEnvbody
+	if err := json.Unmarshal(requests[3].Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	entries := body.BindEnv.BindServices[testService]
+	if len(entries) != 2 || !reflect.DeepEqual(entries[0], first) || !reflect.DeepEqual(entries[1], second) {
+		t.Errorf("BIND_SERVICES in PUT body = %+v", entries)
+	}
+
+	//删除时只去掉对应条目
+	if err := client.SetCallerEnv(stack.Id, nodeId, testService, aos.EnvSetEntity{Name: "binding-1"}, testToken, aos.MODE_DEL_OPERATE); err != nil {
+		t.Fatal(err)
+	}
+	requests = s.Requests()
+	body = aos.SetEnvbody{}
+	if err := json.Unmarshal(requests[len(requests)-1].Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if entries = body.BindEnv.BindServices[testService]; len(entries) != 1 || !reflect.DeepEqual(entries[0], second) {
+		t.Errorf("BIND_SERVICES after delete = %+v", entries)
+	}
+}
+
+func TestReconfigureRequest(t *testing.T) {
+	s := aostest.NewServer()
+	defer s.Close()
+	stack := s.AddStack("consumer", "", aostest.STATUS_RUNNING)
+
+	if err := s.Client().Reconfigure(stack.Id, testToken); err != nil {
+		t.Fatal(err)
+	}
+	requests := s.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("requests = %+v", requests)
+	}
+	checkRequest(t, requests[0], http.MethodPut, aos.APP_ROUTER_PREFIX+"/"+stack.Id+"/actions")
+	var body map[string]interface{}
+	if err := json.Unmarshal(requests[0].Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 1 || body["lifecycle"] != aostest.LIFECYCLE_RECONFIGURE {
+		t.Errorf("body = %s", requests[0].Body)
+	}
+
+	s.Inject(aostest.Failure{Op: aostest.OP_ACTION, Lifecycle: aostest.LIFECYCLE_RECONFIGURE, StatusCode: http.StatusConflict, Times: 1})
+	if err := s.Client().Reconfigure(stack.Id, testToken); err == nil {
+		t.Error("Reconfigure with injected 409 succeeded")
+	}
+}
@@ -0,0 +1,526 @@
+// 用于集成测试的 AOS: 基于 httptest 实现 aos 包使用的 /v2/stacks 接口, 数据只保存在内存中.
+//
+// stack 的状态按脚本变化: 每次 action(或删除)之后, 查询 stack 时依次返回脚本中的状态,
+// 例如 Script(LIFECYCLE_CREATE, STATUS_PROCESSING, STATUS_ABNORMAL) 让之后启动的 stack 启动失败.
+// Inject 可以让指定接口返回错误或直接断开连接.
+package aostest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"service-broker/aos"
+	http_client "service-broker/rest"
+)
+
+// 接口名称, 用于 Failure 和 Request
+const (
+	OP_CREATE         = "create"         // POST /v2/stacks
+	OP_LIST           = "list"           // GET /v2/stacks
+	OP_GET            = "get"            // GET /v2/stacks/{id}
+	OP_DELETE         = "delete"         // DELETE /v2/stacks/{id}
+	OP_ACTION         = "action"         // PUT /v2/stacks/{id}/actions
+	OP_NODES          = "nodes"          // GET /v2/stacks/{id}/nodes
+	OP_NODE           = "node"           // GET /v2/stacks/{id}/nodes/{node_id}
+	OP_GET_PROPERTIES = "get_properties" // GET /v2/stacks/{id}/nodes/{node_id}/properties
+	OP_PUT_PROPERTIES = "put_properties" // PUT /v2/stacks/{id}/nodes/{node_id}/properties
+	OP_OUTPUTS        = "outputs"        // GET /v2/stacks/{id}/outputs
+)
+
+// 注入的错误: 匹配的请求不再处理, 直接返回 StatusCode 和 Body
+type Failure struct {
+	Op         string // OP_*
+	Lifecycle  string // 只对 OP_ACTION 有效, 为空时匹配所有 lifecycle
+	StackId    string // 为空时匹配所有 stack
+	StatusCode int    // 为 0 时不返回完整的响应, 直接断开连接
+	Body       string
+	Times      int // 生效次数, 为 0 时一直生效直到 ClearFailures
+}
+
+// 收到的请求, 用于检查 broker 的调用
+type Request struct {
+	Method    string
+	Path      string
+	Op        string
+	StackId   string
+	Lifecycle string
+	Token     string
+	Header    http.Header
+	Body      []byte
+	Failed    bool // 是否命中了注入的错误
+}
+
+type Server struct {
+	URL string // 作为 aos.Client 的 Endpoint
+
+	server   *httptest.Server
+	mu       sync.Mutex
+	token    string
+	seq      int
+	stacks   map[string]*Stack
+	scripts  map[string][]string
+	failures []*Failure
+	requests []Request
+}
+
+func NewServer() *Server {
+	s := &Server{
+		stacks:  make(map[string]*Stack),
+		scripts: DefaultScripts(),
+	}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// 指向该服务的 aos.Client, 日志输出到 beego
+func (s *Server) Client() *aos.Client {
+	return aos.NewClient(s.URL, &http_client.Client{HTTPClient: s.server.Client()}, nil)
+}
+
+// 指向该服务的区域, 用于 aos.NewRegistry
+func (s *Server) Region(name string) *aos.Region {
+	return &aos.Region{Name: name, Client: s.Client()}
+}
+
+// 非空时校验请求头中的 X-Auth-Token, 不一致时返回 401
+func (s *Server) RequireToken(token string) {
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+}
+
+// 设置之后的 lifecycle 执行后 stack 依次经过的状态, 对已在进行中的 stack 不生效
+func (s *Server) Script(lifecycle string, statuses ...string) {
+	s.mu.Lock()
+	s.scripts[lifecycle] = append([]string(nil), statuses...)
+	s.mu.Unlock()
+}
+
+// 直接设置 stack 的状态, 并丢弃尚未走完的脚本
+func (s *Server) SetStatus(stackId, status string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.stacks[stackId]
+	if !ok {
+		return false
+	}
+	stack.Status = status
+	stack.pending = nil
+	return true
+}
+
+// 走完 stack 剩余的脚本, 删除中的 stack 被移除
+func (s *Server) Settle(stackId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.stacks[stackId]
+	if !ok {
+		return false
+	}
+	for len(stack.pending) > 0 {
+		stack.advance()
+	}
+	if stack.deleting {
+		delete(s.stacks, stackId)
+	}
+	return true
+}
+
+func (s *Server) SetOutputs(stackId string, outputs map[string]interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.stacks[stackId]
+	if !ok {
+		return false
+	}
+	stack.Outputs = copyMap(outputs)
+	return true
+}
+
+// 不经过接口直接添加 stack, 例如模拟 broker 不知道的 stack
+func (s *Server) AddStack(name, projectId, status string) *Stack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack := s.newStack(name, "", projectId, nil)
+	stack.Status = status
+	return stack.clone()
+}
+
+// 不经过接口直接移除 stack, 例如模拟在 AOS 上被手工删除
+func (s *Server) RemoveStack(stackId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.stacks[stackId]; !ok {
+		return false
+	}
+	delete(s.stacks, stackId)
+	return true
+}
+
+// stack 的副本
+func (s *Server) Stack(stackId string) (*Stack, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.stacks[stackId]
+	if !ok {
+		return nil, false
+	}
+	return stack.clone(), true
+}
+
+// 按 id 排序的全部 stack 副本
+func (s *Server) Stacks() []*Stack {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stacks := make([]*Stack, 0, len(s.stacks))
+	for _, stack := range s.sortedStacks() {
+		stacks = append(stacks, stack.clone())
+	}
+	return stacks
+}
+
+func (s *Server) Inject(f Failure) {
+	s.mu.Lock()
+	s.failures = append(s.failures, &f)
+	s.mu.Unlock()
+}
+
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	s.failures = nil
+	s.mu.Unlock()
+}
+
+// 按顺序返回收到的全部请求
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, nodeId, ok := route(r)
+	req.Body = body
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown path "+r.Method+" "+r.URL.Path)
+		return
+	}
+	var action Action
+	if req.Op == OP_ACTION {
+		if err = json.Unmarshal(body, &action); err != nil || action.Lifecycle == "" {
+			writeError(w, http.StatusBadRequest, "invalid action")
+			return
+		}
+		req.Lifecycle = action.Lifecycle
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && req.Token != s.token {
+		s.requests = append(s.requests, req)
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	f := s.matchFailure(req)
+	req.Failed = f != nil
+	s.requests = append(s.requests, req)
+	if f != nil {
+		if f.StatusCode == 0 {
+			closeConnection(w)
+			return
+		}
+		w.WriteHeader(f.StatusCode)
+		w.Write([]byte(f.Body))
+		return
+	}
+	if req.Op == OP_CREATE {
+		s.create(w, body)
+		return
+	}
+	if req.Op == OP_LIST {
+		s.list(w, r)
+		return
+	}
+	stack, ok := s.stacks[req.StackId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "stack "+req.StackId+" not found")
+		return
+	}
+	switch req.Op {
+	case OP_GET:
+		if !stack.advance() {
+			delete(s.stacks, stack.Id)
+			writeError(w, http.StatusNotFound, "stack "+req.StackId+" not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, stack.info())
+	case OP_DELETE:
+		s.delete(w, stack)
+	case OP_ACTION:
+		s.action(w, stack, action)
+	case OP_NODES:
+		nodeType := r.URL.Query().Get("node_type")
+		nodes := make([]aos.AppNodeInfo, 0, len(stack.Nodes))
+		for _, n := range stack.Nodes {
+			if nodeType == "" || n.Type == nodeType {
+				nodes = append(nodes, aos.AppNodeInfo{NodeId: n.Id, InstNum: n.Instances, Type: n.Type})
+			}
+		}
+		writeJSON(w, http.StatusOK, nodes)
+	case OP_OUTPUTS:
+		outputs := aos.Outputs{Outputs: make(map[string]aos.Output, len(stack.Outputs))}
+		for k, v := range stack.Outputs {
+			outputs.Outputs[k] = aos.Output{Value: v}
+		}
+		writeJSON(w, http.StatusOK, outputs)
+	default:
+		node := stack.node(nodeId)
+		if node == nil {
+			writeError(w, http.StatusNotFound, "node "+nodeId+" not found")
+			return
+		}
+		s.nodeRequest(w, r, req.Op, node, body)
+	}
+}
+
+// 根据方法和路径确定接口, 第二个返回值为路径中的 node id
+func route(r *http.Request) (Request, string, bool) {
+	req := Request{Method: r.Method, Path: r.URL.Path, Token: r.Header.Get("X-Auth-Token"), Header: r.Header.Clone()}
+	if !strings.HasPrefix(r.URL.Path, aos.APP_ROUTER_PREFIX) {
+		return req, "", false
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, aos.APP_ROUTER_PREFIX), "/")
+	var parts []string
+	if rest != "" {
+		parts = strings.Split(rest, "/")
+		req.StackId = parts[0]
+	}
+	var nodeId string
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		req.Op = OP_CREATE
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		req.Op = OP_LIST
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		req.Op = OP_GET
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		req.Op = OP_DELETE
+	case len(parts) == 2 && parts[1] == "actions" && r.Method == http.MethodPut:
+		req.Op = OP_ACTION
+	case len(parts) == 2 && parts[1] == "nodes" && r.Method == http.MethodGet:
+		req.Op = OP_NODES
+	case len(parts) == 2 && parts[1] == "outputs" && r.Method == http.MethodGet:
+		req.Op = OP_OUTPUTS
+	case len(parts) == 3 && parts[1] == "nodes" && r.Method == http.MethodGet:
+		req.Op = OP_NODE
+		nodeId = parts[2]
+	case len(parts) == 4 && parts[1] == "nodes" && parts[3] == "properties" && r.Method == http.MethodGet:
+		req.Op = OP_GET_PROPERTIES
+		nodeId = parts[2]
+	case len(parts) == 4 && parts[1] == "nodes" && parts[3] == "properties" && r.Method == http.MethodPut:
+		req.Op = OP_PUT_PROPERTIES
+		nodeId = parts[2]
+	default:
+		return req, "", false
+	}
+	return req, nodeId, true
+}
+
+// 找到第一个匹配的注入错误并扣减次数, 调用方持有 s.mu
+func (s *Server) matchFailure(req Request) *Failure {
+	for i, f := range s.failures {
+		if f.Op != req.Op || (f.StackId != "" && f.StackId != req.StackId) ||
+			(f.Lifecycle != "" && f.Lifecycle != req.Lifecycle) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) create(w http.ResponseWriter, body []byte) {
+	var req aos.CreateAppReq
+	if err := json.Unmarshal(body, &req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid create request")
+		return
+	}
+	inputs, _ := req.InputsJson.(map[string]interface{})
+	stack := s.newStack(req.Name, req.TemplateId, req.ProjectId, inputs)
+	writeJSON(w, http.StatusCreated, aos.CreateAppResp{Guid: stack.Id})
+}
+
+// 新建的 stack 处于 Pending, 有一个节点; outputs 中包含 aos.GetDashboardUrl 需要的 hostip 和 address_port.
+// address_port 为数字, 需要字符串时用 SetOutputs 覆盖
+func (s *Server) newStack(name, templateId, projectId string, inputs map[string]interface{}) *Stack {
+	s.seq++
+	id := "stack-" + strconv.Itoa(s.seq)
+	node := &Node{
+		Id:         id + "-node",
+		Type:       aos.AOS_BLUEPRINT_NODETYPE,
+		Instances:  1,
+		HostIp:     DEFAULT_HOST_IP,
+		NodePort:   FIRST_NODE_PORT + s.seq,
+		Properties: []byte("{}"),
+	}
+	stack := &Stack{
+		Id:         id,
+		Name:       name,
+		TemplateId: templateId,
+		ProjectId:  projectId,
+		Inputs:     copyMap(inputs),
+		Status:     STATUS_PENDING,
+		Outputs: map[string]interface{}{
+			"hostip":       node.HostIp,
+			"address_port": node.NodePort,
+		},
+		Nodes: []*Node{node},
+	}
+	s.stacks[id] = stack
+	return stack
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	resp := aos.ListAppsResp{Stacks: []aos.StackInfo{}}
+	for _, stack := range s.sortedStacks() {
+		if projectId := query.Get("project_id"); projectId != "" && stack.ProjectId != projectId {
+			continue
+		}
+		if name := query.Get("name"); name != "" && stack.Name != name {
+			continue
+		}
+		resp.Stacks = append(resp.Stacks, stack.info())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) delete(w http.ResponseWriter, stack *Stack) {
+	if !stack.deleting {
+		stack.deleting = true
+		stack.pending = append([]string(nil), s.scripts[LIFECYCLE_DELETE]...)
+		if len(stack.pending) == 0 {
+			delete(s.stacks, stack.Id)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 记录 action, upgrade 的参数合并到 stack 的参数中, 然后按脚本改变状态
+func (s *Server) action(w http.ResponseWriter, stack *Stack, action Action) {
+	if stack.deleting {
+		writeError(w, http.StatusConflict, "stack "+stack.Id+" is being deleted")
+		return
+	}
+	stack.Actions = append(stack.Actions, action)
+	if action.Lifecycle == LIFECYCLE_UPGRADE {
+		if stack.Inputs == nil {
+			stack.Inputs = make(map[string]interface{})
+		}
+		for k, v := range action.Inputs {
+			stack.Inputs[k] = v
+		}
+	}
+	if script := s.scripts[action.Lifecycle]; len(script) > 0 {
+		stack.pending = append([]string(nil), script...)
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// 节点详情与 properties; 写 properties 时带 If-Match 且与当前版本不一致返回 412
+func (s *Server) nodeRequest(w http.ResponseWriter, r *http.Request, op string, node *Node, body []byte) {
+	switch op {
+	case OP_NODE:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"runtime_properties": map[string]interface{}{
+				"Service": map[string]interface{}{
+					"ports": []interface{}{map[string]interface{}{"nodePort": node.NodePort}},
+				},
+			},
+			"instances": map[string]interface{}{
+				"items": []interface{}{map[string]interface{}{
+					"status": map[string]interface{}{"hostIP": node.HostIp},
+				}},
+			},
+		})
+	case OP_GET_PROPERTIES:
+		w.Header().Set("ETag", node.etag())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(node.Properties)
+	case OP_PUT_PROPERTIES:
+		if match := r.Header.Get("If-Match"); match != "" && match != node.etag() {
+			writeError(w, http.StatusPreconditionFailed, "properties of node "+node.Id+" have been modified")
+			return
+		}
+		if !json.Valid(body) {
+			writeError(w, http.StatusBadRequest, "invalid properties")
+			return
+		}
+		node.Properties = append([]byte(nil), body...)
+		node.Version++
+		w.Header().Set("ETag", node.etag())
+		writeJSON(w, http.StatusOK, struct{}{})
+	}
+}
+
+// 调用方持有 s.mu
+func (s *Server) sortedStacks() []*Stack {
+	stacks := make([]*Stack, 0, len(s.stacks))
+	for _, stack := range s.stacks {
+		stacks = append(stacks, stack)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return len(stacks[i].Id) < len(stacks[j].Id) || (len(stacks[i].Id) == len(stacks[j].Id) && stacks[i].Id < stacks[j].Id)
+	})
+	return stacks
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	body, _ := json.Marshal(data)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error_msg": message})
+}
+
+// 模拟网络故障: 只返回状态行后断开连接.
+// 已经收到部分响应, net/http 不会像连接直接关闭时那样自动重试 GET 等幂等请求.
+func closeConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "connection reset")
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	buf.WriteString("HTTP/1.1 200 OK\r\n")
+	buf.Flush()
+	conn.Close()
+}
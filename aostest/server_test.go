@@ -0,0 +1,196 @@
+package aostest
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"service-broker/aos"
+	"service-broker/common"
+)
+
+const testToken = "token"
+
+func TestStackLifecycle(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+
+	appId, err := client.CreateApp("i-redis-abcdefghij", "blueprint-1", map[string]interface{}{"size": "1"}, testToken, "project-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack, ok := s.Stack(appId)
+	if !ok || stack.TemplateId != "blueprint-1" || stack.ProjectId != "project-1" || stack.Inputs["size"] != "1" {
+		t.Fatalf("stack = %+v", stack)
+	}
+	expectStatus(t, client, appId, STATUS_PENDING)
+	if _, success, err := client.StartApp(appId, testToken); err != nil || !success {
+		t.Fatalf("StartApp: success=%v err=%v", success, err)
+	}
+	expectStatus(t, client, appId, STATUS_PROCESSING)
+	expectStatus(t, client, appId, STATUS_RUNNING)
+	expectStatus(t, client, appId, STATUS_RUNNING)
+
+	found, err := client.FindAppByName("i-redis-abcdefghij", testToken, "project-1")
+	if err != nil || found == nil || found.Id != appId {
+		t.Fatalf("FindAppByName = %+v, %v", found, err)
+	}
+	if found, _ = client.FindAppByName("i-redis-abcdefghij", testToken, "project-2"); found != nil {
+		t.Errorf("FindAppByName in other project = %+v", found)
+	}
+
+	if _, success, err := client.DeleteApp(appId, testToken); err != nil || !success {
+		t.Fatalf("DeleteApp: success=%v err=%v", success, err)
+	}
+	expectStatus(t, client, appId, STATUS_PROCESSING)
+	expectStatus(t, client, appId, aos.APP_NOT_EXIST)
+	if _, ok := s.Stack(appId); ok {
+		t.Error("stack still exists after delete")
+	}
+}
+
+func TestScript(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+	s.Script(LIFECYCLE_CREATE, STATUS_PROCESSING, STATUS_ABNORMAL)
+
+	appId, err := client.CreateApp("i-redis-abcdefghij", "blueprint-1", nil, testToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.StartApp(appId, testToken)
+	if !s.Settle(appId) {
+		t.Fatal("Settle: stack not found")
+	}
+	expectStatus(t, client, appId, STATUS_ABNORMAL)
+}
+
+func TestDashboardUrl(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+	stack := s.AddStack("i-redis-abcdefghij", "", STATUS_RUNNING)
+	port := strconv.Itoa(stack.Nodes[0].NodePort)
+
+	//默认的 address_port 为数字
+	if _, ok := stack.Outputs["address_port"].(int); !ok {
+		t.Errorf("address_port = %#v, want a number", stack.Outputs["address_port"])
+	}
+	url, err := client.GetDashboardUrl(stack.Id, testToken)
+	if err != nil || url != DEFAULT_HOST_IP+":"+port {
+		t.Errorf("GetDashboardUrl = %q, %v", url, err)
+	}
+	s.SetOutputs(stack.Id, map[string]interface{}{"address_port": port})
+	url, err = client.GetDashboardUrl(stack.Id, testToken)
+	if err != nil || url != DEFAULT_HOST_IP+":"+port {
+		t.Errorf("GetDashboardUrl with string port = %q, %v", url, err)
+	}
+	s.SetOutputs(stack.Id, map[string]interface{}{})
+	if _, err = client.GetDashboardUrl(stack.Id, testToken); err == nil {
+		t.Error("GetDashboardUrl without address_port succeeded")
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+	stack := s.AddStack("i-redis-abcdefghij", "", STATUS_RUNNING)
+	s.Inject(Failure{Op: OP_GET, StackId: stack.Id, StatusCode: http.StatusServiceUnavailable, Times: 1})
+
+	if _, err := client.QueryAppStatus(stack.Id, testToken); common.KindOf(err) != common.KindInternal {
+		t.Errorf("QueryAppStatus with injected 503: err = %v", err)
+	}
+	expectStatus(t, client, stack.Id, STATUS_RUNNING)
+
+	s.Inject(Failure{Op: OP_GET, StackId: stack.Id})
+	if _, err := client.QueryAppStatus(stack.Id, testToken); err == nil {
+		t.Error("QueryAppStatus with closed connection succeeded")
+	}
+	s.ClearFailures()
+	expectStatus(t, client, stack.Id, STATUS_RUNNING)
+
+	var failed int
+	for _, req := range s.Requests() {
+		if req.Op != OP_GET || req.StackId != stack.Id {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if req.Failed {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Errorf("failed requests = %d, want 2", failed)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := s.Client()
+	stack := s.AddStack("i-redis-abcdefghij", "", STATUS_RUNNING)
+	s.RequireToken(testToken)
+
+	if _, err := client.QueryAppStatus(stack.Id, "other"); err == nil {
+		t.Error("QueryAppStatus with invalid token succeeded")
+	}
+	expectStatus(t, client, stack.Id, STATUS_RUNNING)
+}
+
+func TestPropertiesVersion(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	stack := s.AddStack("i-redis-abcdefghij", "", STATUS_RUNNING)
+	url := s.URL + aos.APP_ROUTER_PREFIX + "/" + stack.Id + "/nodes/" + stack.Nodes[0].Id + "/properties"
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if code := putProperties(t, url, etag, `{"env":{}}`); code != http.StatusOK {
+		t.Errorf("PUT with current ETag: status %d", code)
+	}
+	if code := putProperties(t, url, etag, `{"env":{"a":"b"}}`); code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale ETag: status %d, want 412", code)
+	}
+	if code := putProperties(t, url, "", `not json`); code != http.StatusBadRequest {
+		t.Errorf("PUT invalid JSON: status %d, want 400", code)
+	}
+	stack, _ = s.Stack(stack.Id)
+	if string(stack.Nodes[0].Properties) != `{"env":{}}` || stack.Nodes[0].Version != 1 {
+		t.Errorf("node = %+v", stack.Nodes[0])
+	}
+}
+
+func expectStatus(t *testing.T, client *aos.Client, appId, want string) {
+	t.Helper()
+	status, err := client.QueryAppStatus(appId, testToken)
+	if err != nil || status != want {
+		t.Fatalf("QueryAppStatus(%s) = %q, %v, want %q", appId, status, err, want)
+	}
+}
+
+func putProperties(t *testing.T, url, etag, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,126 @@
+package aostest
+
+import (
+	"strconv"
+
+	"service-broker/aos"
+)
+
+// stack 的状态, 与 AOS 一致
+const (
+	STATUS_PENDING    = "Pending"
+	STATUS_PROCESSING = "Processing"
+	STATUS_RUNNING    = aos.RUNNING
+	STATUS_ABNORMAL   = aos.ABNORMAL
+)
+
+// action 与删除对应的 lifecycle, 用于 Script
+const (
+	LIFECYCLE_CREATE      = "create"
+	LIFECYCLE_UPGRADE     = aos.LIFECYCLE_UPGRADE
+	LIFECYCLE_RECONFIGURE = "reconfigure"
+	LIFECYCLE_DELETE      = "delete"
+)
+
+const (
+	DEFAULT_HOST_IP = "127.0.0.1"
+	FIRST_NODE_PORT = 30000 // 第 n 个 stack 的节点端口为 FIRST_NODE_PORT + n
+)
+
+// 未调用 Script 时各 lifecycle 之后 stack 依次经过的状态, 每查询一次 stack 前进一步.
+// delete 的状态走完后 stack 被移除, 查询返回 404.
+func DefaultScripts() map[string][]string {
+	return map[string][]string{
+		LIFECYCLE_CREATE:  {STATUS_PROCESSING, STATUS_RUNNING},
+		LIFECYCLE_UPGRADE: {STATUS_PROCESSING, STATUS_RUNNING},
+		LIFECYCLE_DELETE:  {STATUS_PROCESSING},
+	}
+}
+
+// 一次 action 请求
+type Action struct {
+	Lifecycle string                 `json:"lifecycle"`
+	Inputs    map[string]interface{} `json:"inputs,omitempty"`
+}
+
+// fake AOS 中的一个 stack
+type Stack struct {
+	Id         string
+	Name       string
+	TemplateId string
+	ProjectId  string
+	Inputs     map[string]interface{}
+	Status     string
+	Outputs    map[string]interface{}
+	Nodes      []*Node
+	Actions    []Action // 按顺序记录收到的 action
+
+	pending  []string // 后续查询依次返回的状态
+	deleting bool
+}
+
+// stack 中的节点, properties 即 BIND_SERVICES 等环境变量
+type Node struct {
+	Id         string
+	Type       string
+	Instances  int
+	HostIp     string
+	NodePort   int
+	Properties []byte
+	Version    int // 每次写 properties 加一, 作为 ETag
+}
+
+// properties 的 ETag, 形如 "v1"
+func (n *Node) etag() string {
+	return `"v` + strconv.Itoa(n.Version) + `"`
+}
+
+// 查询一次状态, 按脚本前进一步; 删除完成时返回 false
+func (s *Stack) advance() bool {
+	if len(s.pending) > 0 {
+		s.Status = s.pending[0]
+		s.pending = s.pending[1:]
+		return true
+	}
+	return !s.deleting
+}
+
+// 返回给调用方的副本, 避免在锁外读写
+func (s *Stack) clone() *Stack {
+	c := *s
+	c.Inputs = copyMap(s.Inputs)
+	c.Outputs = copyMap(s.Outputs)
+	c.Actions = append([]Action(nil), s.Actions...)
+	c.pending = append([]string(nil), s.pending...)
+	c.Nodes = make([]*Node, 0, len(s.Nodes))
+	for _, n := range s.Nodes {
+		node := *n
+		node.Properties = append([]byte(nil), n.Properties...)
+		c.Nodes = append(c.Nodes, &node)
+	}
+	return &c
+}
+
+func (s *Stack) node(nodeId string) *Node {
+	for _, n := range s.Nodes {
+		if n.Id == nodeId {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *Stack) info() aos.StackInfo {
+	return aos.StackInfo{Id: s.Id, Name: s.Name, Status: s.Status, TemplateId: s.TemplateId, ProjectId: s.ProjectId}
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
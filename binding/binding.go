@@ -0,0 +1,137 @@
+package binding
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+
+	"service-broker/aos"
+	"service-broker/catalog"
+)
+
+const (
+	DEFAULT_USERNAME_INPUT  = "username"
+	DEFAULT_PASSWORD_INPUT  = "password"
+	DEFAULT_USERNAME_PREFIX = "u"
+	DEFAULT_PASSWORD_LENGTH = 16
+	CREDENTIAL_USERNAME     = "username"
+	CREDENTIAL_PASSWORD     = "password"
+
+	passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// 生成和回收绑定凭据的策略, 由 plan 的 binding 配置决定
+type Strategy interface {
+	Bind(client *aos.Client, appId, token, bindingId string, parameters map[string]interface{}) (map[string]interface{}, error)
+	Unbind(client *aos.Client, appId, token, bindingId string, credentials map[string]interface{}) error
+}
+
+func ForPlan(plan *catalog.Plan) Strategy {
+	cfg := plan.Binding
+	if cfg == nil {
+		return &outputsStrategy{}
+	}
+	if cfg.Strategy == catalog.BINDING_STRATEGY_USER {
+		return &userStrategy{outputs: outputsStrategy{mapping: cfg.Outputs}, cfg: *cfg.User}
+	}
+	return &outputsStrategy{mapping: cfg.Outputs}
+}
+
+// 从 blueprint outputs 中读取 host、port、uri 等凭据, 未配置映射时返回全部 outputs
+type outputsStrategy struct {
+	mapping map[string]string
+}
+
+func (s *outputsStrategy) Bind(client *aos.Client, appId, token, bindingId string, parameters map[string]interface{}) (map[string]interface{}, error) {
+	outputs, err := client.GetBlueprintOutput(appId, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.mapping) == 0 {
+		return outputs, nil
+	}
+	credentials := make(map[string]interface{}, len(s.mapping))
+	for key, name := range s.mapping {
+		value, ok := outputs[name]
+		if !ok {
+			return nil, errors.New("blueprint output " + name + " not found for credential " + key)
+		}
+		credentials[key] = value
+	}
+	return credentials, nil
+}
+
+func (s *outputsStrategy) Unbind(client *aos.Client, appId, token, bindingId string, credentials map[string]interface{}) error {
+	return nil
+}
+
+// 在 outputs 的基础上, 通过 action lifecycle 为每个绑定创建独立的用户名和密码
+type userStrategy struct {
+	outputs outputsStrategy
+	cfg     catalog.UserBinding
+}
+
+func (s *userStrategy) Bind(client *aos.Client, appId, token, bindingId string, parameters map[string]interface{}) (map[string]interface{}, error) {
+	credentials, err := s.outputs.Bind(client, appId, token, bindingId, parameters)
+	if err != nil {
+		return nil, err
+	}
+	length := s.cfg.PasswordLength
+	if length <= 0 {
+		length = DEFAULT_PASSWORD_LENGTH
+	}
+	password, err := GeneratePassword(length)
+	if err != nil {
+		return nil, err
+	}
+	username := Username(orDefault(s.cfg.UsernamePrefix, DEFAULT_USERNAME_PREFIX), bindingId)
+	inputs := map[string]interface{}{
+		orDefault(s.cfg.UsernameInput, DEFAULT_USERNAME_INPUT): username,
+		orDefault(s.cfg.PasswordInput, DEFAULT_PASSWORD_INPUT): password,
+	}
+	if err = client.RunAction(appId, token, s.cfg.CreateLifecycle, inputs); err != nil {
+		return nil, err
+	}
+	credentials[CREDENTIAL_USERNAME] = username
+	credentials[CREDENTIAL_PASSWORD] = password
+	return credentials, nil
+}
+
+func (s *userStrategy) Unbind(client *aos.Client, appId, token, bindingId string, credentials map[string]interface{}) error {
+	username, _ := credentials[CREDENTIAL_USERNAME].(string)
+	if username == "" {
+		username = Username(orDefault(s.cfg.UsernamePrefix, DEFAULT_USERNAME_PREFIX), bindingId)
+	}
+	inputs := map[string]interface{}{
+		orDefault(s.cfg.UsernameInput, DEFAULT_USERNAME_INPUT): username,
+	}
+	return client.RunAction(appId, token, s.cfg.DeleteLifecycle, inputs)
+}
+
+// 根据绑定 id 生成固定的用户名, 同一个绑定重试时用户名不变
+func Username(prefix, bindingId string) string {
+	sum := sha256.Sum256([]byte(bindingId))
+	return prefix + hex.EncodeToString(sum[:])[:12]
+}
+
+func GeneratePassword(length int) (string, error) {
+	max := big.NewInt(int64(len(passwordChars)))
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordChars[n.Int64()]
+	}
+	return string(password), nil
+}
+
+func orDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,288 @@
+package catalog
+
+import (
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"service-broker/models"
+	"sigs.k8s.io/yaml"
+)
+
+// OSB 规范中 plan 的 schemas
+type Schemas struct {
+	ServiceInstance *InstanceSchemas `json:"service_instance,omitempty"`
+	ServiceBinding  *BindingSchemas  `json:"service_binding,omitempty"`
+}
+
+type InstanceSchemas struct {
+	Create *InputParameters `json:"create,omitempty"`
+	Update *InputParameters `json:"update,omitempty"`
+}
+
+type BindingSchemas struct {
+	Create *InputParameters `json:"create,omitempty"`
+}
+
+type InputParameters struct {
+	Parameters map[string]interface{} `json:"parameters,omitempty"` // JSON Schema
+}
+
+// plan 中输出到 /v2/catalog 的字段
+type PlanSpec struct {
+	Id                     string                  `json:"id"`
+	Name                   string                  `json:"name"`
+	Description            string                  `json:"description"`
+	Metadata               map[string]interface{}  `json:"metadata,omitempty"`
+	Free                   *bool                   `json:"free,omitempty"`
+	Bindable               *bool                   `json:"bindable,omitempty"`
+	PlanUpdateable         *bool                   `json:"plan_updateable,omitempty"`
+	MaintenanceInfo        *models.MaintenanceInfo `json:"maintenance_info,omitempty"`
+	MaximumPollingDuration int                     `json:"maximum_polling_duration,omitempty"`
+	Schemas                *Schemas                `json:"schemas,omitempty"`
+}
+
+// 配置文件中的 plan, 除 OSB 字段外还包含 broker 内部使用的字段
+type Plan struct {
+	PlanSpec
+	Backend     string                 `json:"backend,omitempty"`     // 提供实例的后端, 默认 aos
+	BlueprintId string                 `json:"blueprint_id"`          // plan 对应的 AOS 模板
+	InputsJson  map[string]interface{} `json:"inputs_json,omitempty"` // 创建实例时的默认参数, 用户参数优先
+	Binding     *BindingConfig         `json:"binding,omitempty"`     // 生成绑定凭据的方式, 为空时返回 blueprint 的全部 outputs
+	Timeouts    *OperationTimeouts     `json:"timeouts,omitempty"`    // 异步操作的最长时间, 超时后视为失败
+
+	schemas compiledSchemas
+}
+
+const (
+	BINDING_STRATEGY_OUTPUTS = "outputs" // 从 blueprint outputs 中读取凭据
+	BINDING_STRATEGY_USER    = "user"    // 在 outputs 基础上, 通过 action lifecycle 为每个绑定创建独立的用户
+)
+
+type BindingConfig struct {
+	Strategy string            `json:"strategy"`
+	Outputs  map[string]string `json:"outputs,omitempty"` // 凭据字段 -> blueprint output 名称, 例如 host: hostip
+	User     *UserBinding      `json:"user,omitempty"`
+}
+
+// user 策略的参数
+type UserBinding struct {
+	CreateLifecycle string `json:"create_lifecycle"`         // 创建用户的 action lifecycle
+	DeleteLifecycle string `json:"delete_lifecycle"`         // 删除用户的 action lifecycle
+	UsernameInput   string `json:"username_input,omitempty"` // lifecycle 中用户名参数的名称, 默认 username
+	PasswordInput   string `json:"password_input,omitempty"` // lifecycle 中密码参数的名称, 默认 password
+	UsernamePrefix  string `json:"username_prefix,omitempty"`
+	PasswordLength  int    `json:"password_length,omitempty"`
+}
+
+// 各操作的最长时间(秒), 未设置时使用 maximum_polling_duration
+type OperationTimeouts struct {
+	Create int `json:"create,omitempty"`
+	Update int `json:"update,omitempty"`
+	Delete int `json:"delete,omitempty"`
+}
+
+// 操作 kind(create/update/delete) 的最长时间, 返回 0 表示未配置
+func (p *Plan) MaxDuration(kind string) time.Duration {
+	seconds := 0
+	if p.Timeouts != nil {
+		switch kind {
+		case "create":
+			seconds = p.Timeouts.Create
+		case "update":
+			seconds = p.Timeouts.Update
+		case "delete":
+			seconds = p.Timeouts.Delete
+		}
+	}
+	if seconds <= 0 {
+		seconds = p.MaximumPollingDuration
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// 合并默认参数与用户参数, 同名参数以用户参数为准
+func (p *Plan) Inputs(parameters map[string]interface{}) map[string]interface{} {
+	inputs := make(map[string]interface{}, len(p.InputsJson)+len(parameters))
+	for k, v := range p.InputsJson {
+		inputs[k] = v
+	}
+	for k, v := range parameters {
+		inputs[k] = v
+	}
+	return inputs
+}
+
+// 请求中携带了 blueprint_id 时, 必须与 plan 对应的模板一致
+func (p *Plan) CheckBlueprint(blueprintId string) error {
+	if blueprintId != "" && blueprintId != p.BlueprintId {
+		return errors.New("blueprint_id " + blueprintId + " is not allowed for plan " + p.Id)
+	}
+	return nil
+}
+
+func (b *BindingConfig) validate() error {
+	if b == nil {
+		return nil
+	}
+	switch b.Strategy {
+	case BINDING_STRATEGY_OUTPUTS:
+		return nil
+	case BINDING_STRATEGY_USER:
+		if b.User == nil || b.User.CreateLifecycle == "" || b.User.DeleteLifecycle == "" {
+			return errors.New("user strategy requires user.create_lifecycle and user.delete_lifecycle")
+		}
+		return nil
+	default:
+		return errors.New("unknown strategy: " + b.Strategy)
+	}
+}
+
+// service 中输出到 /v2/catalog 的字段
+type ServiceSpec struct {
+	Id             string                 `json:"id"`
+	Name           string                 `json:"name"`
+	Description    string                 `json:"description"`
+	Tags           []string               `json:"tags,omitempty"`
+	Requires       []string               `json:"requires,omitempty"`
+	Bindable       bool                   `json:"bindable"`
+	PlanUpdateable bool                   `json:"plan_updateable,omitempty"`
+	Metadata       map[string]interface{} `json:"metadata,omitempty"`
+	// 是否支持 GET 实例和绑定
+	InstancesRetrievable bool `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool `json:"bindings_retrievable,omitempty"`
+}
+
+type Service struct {
+	ServiceSpec
+	Plans []Plan `json:"plans"`
+}
+
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+// GET /v2/catalog 的响应
+type Response struct {
+	Services []ServiceResponse `json:"services"`
+}
+
+type ServiceResponse struct {
+	ServiceSpec
+	Plans []PlanSpec `json:"plans"`
+}
+
+// 从 YAML 或 JSON 文件加载 catalog
+func Load(path string) (*Catalog, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Catalog, error) {
+	var c Catalog
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, errors.New("parse catalog error: " + err.Error())
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	for i := range c.Services {
+		for j := range c.Services[i].Plans {
+			if err := c.Services[i].Plans[j].compileSchemas(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &c, nil
+}
+
+// 检查必填字段以及 id 是否重复
+func (c *Catalog) Validate() error {
+	if len(c.Services) == 0 {
+		return errors.New("catalog has no service")
+	}
+	ids := make(map[string]bool)
+	for _, s := range c.Services {
+		if s.Id == "" || s.Name == "" || s.Description == "" {
+			return errors.New("service id, name and description must not be empty")
+		}
+		if ids[s.Id] {
+			return errors.New("duplicate service id: " + s.Id)
+		}
+		ids[s.Id] = true
+		if len(s.Plans) == 0 {
+			return errors.New("service " + s.Name + " has no plan")
+		}
+		for _, p := range s.Plans {
+			if p.Id == "" || p.Name == "" || p.Description == "" {
+				return errors.New("plan id, name and description of service " + s.Name + " must not be empty")
+			}
+			if ids[p.Id] {
+				return errors.New("duplicate plan id: " + p.Id)
+			}
+			ids[p.Id] = true
+			if p.BlueprintId == "" && (p.Backend == "" || p.Backend == "aos") {
+				return errors.New("plan " + p.Name + " of service " + s.Name + " has no blueprint_id")
+			}
+			if err := p.Binding.validate(); err != nil {
+				return errors.New("plan " + p.Name + " of service " + s.Name + " binding invalid: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// 生成 /v2/catalog 响应, 去掉 broker 内部字段
+func (c *Catalog) Response() Response {
+	res := Response{Services: make([]ServiceResponse, 0, len(c.Services))}
+	for _, s := range c.Services {
+		plans := make([]PlanSpec, 0, len(s.Plans))
+		for _, p := range s.Plans {
+			plans = append(plans, p.PlanSpec)
+		}
+		res.Services = append(res.Services, ServiceResponse{ServiceSpec: s.ServiceSpec, Plans: plans})
+	}
+	return res
+}
+
+func (c *Catalog) Service(serviceId string) (*Service, bool) {
+	for i := range c.Services {
+		if c.Services[i].Id == serviceId {
+			return &c.Services[i], true
+		}
+	}
+	return nil, false
+}
+
+// 查找 service 下的 plan
+func (c *Catalog) Plan(serviceId, planId string) (*Service, *Plan, bool) {
+	s, ok := c.Service(serviceId)
+	if !ok {
+		return nil, nil, false
+	}
+	for i := range s.Plans {
+		if s.Plans[i].Id == planId {
+			return s, &s.Plans[i], true
+		}
+	}
+	return s, nil, false
+}
+
+// plan 未设置 bindable 时继承 service 的设置
+func (s *Service) IsBindable(p *Plan) bool {
+	if p.Bindable != nil {
+		return *p.Bindable
+	}
+	return s.Bindable
+}
+
+// plan 未设置 plan_updateable 时继承 service 的设置
+func (s *Service) IsPlanUpdateable(p *Plan) bool {
+	if p.PlanUpdateable != nil {
+		return *p.PlanUpdateable
+	}
+	return s.PlanUpdateable
+}
@@ -0,0 +1,81 @@
+package catalog
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"service-broker/models"
+)
+
+// plan 中已编译的参数 JSON Schema, 为 nil 表示不校验
+type compiledSchemas struct {
+	instanceCreate *gojsonschema.Schema
+	instanceUpdate *gojsonschema.Schema
+	bindingCreate  *gojsonschema.Schema
+}
+
+func compile(params *InputParameters) (*gojsonschema.Schema, error) {
+	if params == nil || len(params.Parameters) == 0 {
+		return nil, nil
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewGoLoader(params.Parameters))
+}
+
+// 加载 catalog 时编译 plan 的 schemas, schema 不合法时返回错误
+func (p *Plan) compileSchemas() error {
+	p.schemas = compiledSchemas{}
+	if p.Schemas == nil {
+		return nil
+	}
+	var err error
+	if si := p.Schemas.ServiceInstance; si != nil {
+		if p.schemas.instanceCreate, err = compile(si.Create); err != nil {
+			return errors.New("plan " + p.Id + " schemas.service_instance.create invalid: " + err.Error())
+		}
+		if p.schemas.instanceUpdate, err = compile(si.Update); err != nil {
+			return errors.New("plan " + p.Id + " schemas.service_instance.update invalid: " + err.Error())
+		}
+	}
+	if sb := p.Schemas.ServiceBinding; sb != nil {
+		if p.schemas.bindingCreate, err = compile(sb.Create); err != nil {
+			return errors.New("plan " + p.Id + " schemas.service_binding.create invalid: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// 校验参数, 失败时返回 *models.ValidationError, 字段路径以 parameters 开头
+func validate(schema *gojsonschema.Schema, parameters map[string]interface{}) error {
+	if schema == nil {
+		return nil
+	}
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	result, err := schema.Validate(gojsonschema.NewGoLoader(parameters))
+	if err != nil {
+		return err
+	}
+	v := &models.ValidationError{}
+	for _, e := range result.Errors() {
+		field := "parameters"
+		if e.Field() != gojsonschema.STRING_CONTEXT_ROOT {
+			field += "." + strings.TrimPrefix(e.Field(), gojsonschema.STRING_CONTEXT_ROOT+".")
+		}
+		v.Add(field, e.Description())
+	}
+	return v.ErrOrNil()
+}
+
+func (p *Plan) ValidateCreateParameters(parameters map[string]interface{}) error {
+	return validate(p.schemas.instanceCreate, parameters)
+}
+
+func (p *Plan) ValidateUpdateParameters(parameters map[string]interface{}) error {
+	return validate(p.schemas.instanceUpdate, parameters)
+}
+
+func (p *Plan) ValidateBindParameters(parameters map[string]interface{}) error {
+	return validate(p.schemas.bindingCreate, parameters)
+}
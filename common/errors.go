@@ -0,0 +1,138 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// 错误类别, 决定返回给平台的状态码
+type ErrorKind int
+
+const (
+	KindInternal      ErrorKind = iota // 500
+	KindBadRequest                     // 400
+	KindConflict                       // 409
+	KindGone                           // 410
+	KindUnprocessable                  // 422
+)
+
+// OSB 规范定义的 error 字段取值
+const (
+	ERROR_ASYNC_REQUIRED            = "AsyncRequired"
+	ERROR_CONCURRENCY               = "ConcurrencyError"
+	ERROR_REQUIRES_APP              = "RequiresApp"
+	ERROR_MAINTENANCE_INFO_CONFLICT = "MaintenanceInfoConflict"
+)
+
+// 调用 AOS 等后端失败时返回的错误
+type Error struct {
+	Kind       ErrorKind
+	Code       string // OSB 响应中的 error 字段, 可为空
+	Op         string // 失败的操作, 例如 "Create app"
+	StatusCode int    // 后端返回的状态码, 未收到响应时为 0
+	Message    string // 后端的响应体或错误说明
+	Err        error  // 底层错误
+}
+
+func (e *Error) Error() string {
+	msg := e.Op
+	if e.StatusCode != 0 {
+		msg += " (status " + strconv.Itoa(e.StatusCode) + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NewError(kind ErrorKind, op, message string) *Error {
+	return &Error{Kind: kind, Op: op, Message: message}
+}
+
+// 根据后端返回的非 2xx 响应生成错误
+func NewStatusError(op string, statusCode int, body []byte) *Error {
+	return &Error{
+		Kind:       kindOfStatus(statusCode),
+		Op:         op,
+		StatusCode: statusCode,
+		Message:    string(body),
+	}
+}
+
+// 包装请求失败、解析失败等没有收到有效响应的错误
+func WrapError(op string, err error) *Error {
+	return &Error{Kind: KindInternal, Op: op, Err: err}
+}
+
+func kindOfStatus(statusCode int) ErrorKind {
+	switch statusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return KindGone
+	case http.StatusConflict:
+		return KindConflict
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return KindUnprocessable
+	default:
+		return KindInternal
+	}
+}
+
+// 错误类别, 不是 *Error 时视为内部错误
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindInternal
+}
+
+func IsGone(err error) bool {
+	return err != nil && KindOf(err) == KindGone
+}
+
+// 返回给平台的状态码
+func StatusCode(err error) int {
+	switch KindOf(err) {
+	case KindBadRequest:
+		return http.StatusBadRequest
+	case KindConflict:
+		return http.StatusConflict
+	case KindGone:
+		return http.StatusGone
+	case KindUnprocessable:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// 后端错误在某个端点上对应的类别和 OSB error 字段
+type Mapping struct {
+	Kind ErrorKind
+	Code string
+}
+
+// 后端的状态码描述的是后端资源, 不一定适用于平台请求的端点, 例如创建实例时 AOS 返回 404 不代表实例已删除.
+// 由后端状态码产生的错误按 mapping 转换, 未列出的类别视为内部错误; broker 自身产生的错误保持不变
+func MapBackendError(err error, mapping map[ErrorKind]Mapping) error {
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode == 0 {
+		return err
+	}
+	mapped := *e
+	m, ok := mapping[e.Kind]
+	if !ok {
+		m = Mapping{Kind: KindInternal}
+	}
+	mapped.Kind = m.Kind
+	mapped.Code = m.Code
+	return &mapped
+}
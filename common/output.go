@@ -0,0 +1,49 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/astaxie/beego/context"
+	"service-broker/models"
+)
+
+// 输出 OSB 格式的错误响应
+func OutputErrorResponse(ctx *context.Context, code int, res models.ErrorResponse) {
+	body, _ := json.Marshal(res)
+	ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+	ctx.Output.SetStatus(code)
+	ctx.Output.Body(body)
+}
+
+func OutputErrorWithCode(ctx *context.Context, description string, code int) {
+	OutputErrorResponse(ctx, code, models.ErrorResponse{Description: description})
+}
+
+// 根据错误类型确定状态码并输出, description 为面向平台的说明, 会拼接上错误详情
+func OutputError(ctx *context.Context, err error, description string) {
+	code, res := ErrorResponseOf(err, description)
+	OutputErrorResponse(ctx, code, res)
+}
+
+// 根据错误类型生成状态码和响应体, 调用方可以在输出前补充 instance_usable 等字段
+func ErrorResponseOf(err error, description string) (int, models.ErrorResponse) {
+	var validationErr *models.ValidationError
+	if errors.As(err, &validationErr) {
+		res := validationErr.Response()
+		if description != "" {
+			res.Description = description + res.Description
+		}
+		return http.StatusBadRequest, res
+	}
+	res := models.ErrorResponse{Description: description}
+	if err != nil {
+		res.Description += err.Error()
+		var e *Error
+		if errors.As(err, &e) {
+			res.Error = e.Code
+		}
+	}
+	return StatusCode(err), res
+}
@@ -1,21 +1,88 @@
 package main
 
 import (
-	"common"
+	"crypto/subtle"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/astaxie/beego"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"service-broker/aos"
+	"service-broker/catalog"
+	"service-broker/common"
+	"service-broker/models"
+	"service-broker/provisioner"
+	"service-broker/reconciler"
+	"service-broker/store"
+	"service-broker/tracker"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ADMIN_TOKEN_HEADER = "X-Admin-Token"
+
+var errUserdataMismatch = errors.New("userdata does not match the instance")
+
+// 各端点对后端错误的映射. 参数不合法的后端错误视为错误请求; AOS 的 409 说明 app 正在处理其它操作;
+// 只有删除类的端点把后端的 404 视为资源已不存在
+var (
+	provisionErrors = map[common.ErrorKind]common.Mapping{
+		common.KindUnprocessable: {Kind: common.KindBadRequest},
+	}
+	updateErrors = map[common.ErrorKind]common.Mapping{
+		common.KindUnprocessable: {Kind: common.KindBadRequest},
+		common.KindConflict:      {Kind: common.KindUnprocessable, Code: common.ERROR_CONCURRENCY},
+	}
+	bindErrors   = updateErrors
+	deleteErrors = map[common.ErrorKind]common.Mapping{
+		common.KindGone:     {Kind: common.KindGone},
+		common.KindConflict: {Kind: common.KindUnprocessable, Code: common.ERROR_CONCURRENCY},
+	}
 )
 
 type Controller struct {
 	beego.Controller
+	// 以下字段由 InitRoutes 注入, beego 为每个请求新建 Controller 时会复制这些字段
+	Regions *aos.Registry
+	Catalog *catalog.Catalog
+	Store   *store.Store
+	Tracker *tracker.Tracker
+	// 按 plan 的 backend 选择实例的后端
+	Provisioners *provisioner.Registry
+	// 对账结果通过管理接口查询
+	Reconciler *reconciler.Reconciler
+	// 管理接口的凭据, 为空时关闭管理接口
+	AdminToken string
+	// OSB 接口的 basic auth 凭据, BrokerUsername 为空时不校验
+	BrokerUsername string
+	BrokerPassword string
+}
+
+// 校验 OSB 接口的 basic auth, 健康检查、管理接口和自定义页面不需要
+func (this *Controller) Prepare() {
+	path := this.Ctx.Request.URL.Path
+	if this.BrokerUsername == "" || (path != "/v2/catalog" && !strings.HasPrefix(path, "/v2/service_instances/")) {
+		return
+	}
+	username, password, ok := this.Ctx.Request.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(this.BrokerUsername)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(this.BrokerPassword)) != 1 {
+		beego.Warn("Reject unauthorized request "+path+" from", this.Ctx.Input.IP())
+		this.Ctx.Output.Header("WWW-Authenticate", `Basic realm="service broker"`)
+		common.OutputErrorWithCode(this.Ctx, "invalid broker credentials", http.StatusUnauthorized)
+		this.StopRun()
+	}
 }
 
 //查询 catalog
 func (this *Controller) GetServiceCatalog() {
+	this.Output(http.StatusOK, this.Catalog.Response())
+}
+
+//健康检查
+func (this *Controller) HealthCheck() {
 	//因为Broker是服务框架启动的，所以这里仅作为健康检查的API，这里200OK，就认为Broker启动成功
 	this.Output(http.StatusOK, "broker status ok")
 }
@@ -25,7 +92,7 @@ func (this *Controller) CreateInstance() {
 	//调用AOS的API，启动实例
 	token := this.Ctx.Input.Header("X-Auth-Token")
 	instanceId := this.Ctx.Input.Param(":instance_id")
-	var req CreateInstReq
+	var req models.CreateInstReq
 	//解析请求
 	err := json.Unmarshal([]byte(this.Ctx.Input.RequestBody), &req)
 	if err != nil {
@@ -33,103 +100,457 @@ func (this *Controller) CreateInstance() {
 		common.OutputErrorWithCode(this.Ctx, "Unmarshal request body fail", http.StatusBadRequest)
 		return
 	}
-	stackName := aos.GetStackName("i", req.InstanceName, instanceId)
-	//1. 创建APP
-	appId, err := aos.CreateApp(stackName, req.BlueprintId, req.Parameters, token, req.SpaceGuid)
-	var res CreateInstResp
-	res.Userdata = appId
-	res.BaseInfo.ActualId = appId
-	res.BaseInfo.InstanceType = "aos"
-	res.BaseInfo.ActualName = stackName
+	if !this.validate(&req) {
+		return
+	}
+	//根据 plan 确定 AOS 模板, 不接受 catalog 以外的模板
+	service, plan, ok := this.Catalog.Plan(req.ServiceId, req.PlanId)
+	if !ok {
+		beego.Warn("Unknown service_id or plan_id:", req.ServiceId, req.PlanId)
+		common.OutputErrorWithCode(this.Ctx, "unknown service_id "+req.ServiceId+" or plan_id "+req.PlanId, http.StatusBadRequest)
+		return
+	}
+	if err = plan.CheckBlueprint(req.BlueprintId); err != nil {
+		beego.Warn("Check blueprint fail, err:", err)
+		common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//按 plan 的 schemas 校验参数, region 字段由 broker 使用, 不参与校验
+	if err = plan.ValidateCreateParameters(aos.WithoutRegion(req.Parameters)); err != nil {
+		beego.Warn("Validate create parameters fail, err:", err)
+		common.OutputError(this.Ctx, err, "")
+		return
+	}
+	p, err := this.Provisioners.ForPlan(plan)
 	if err != nil {
-		beego.Warn("Call AOS CreateApp fail! err:", err)
-		this.Output(http.StatusInternalServerError, res)
+		beego.Error("Get backend of plan "+plan.Name+" fail, err:", err)
+		common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	//2. 启动APP，异步的，所以直接返回。
-	status, success, err := aos.StartApp(appId, token)
+	instanceName := req.InstanceName
+	if instanceName == "" {
+		instanceName = service.Name
+	}
+	//选择实例所在的区域, 区域信息保存在 userdata 中
+	region, err := this.Regions.Select(req.PlanId, req.Parameters, req.Context)
 	if err != nil {
-		beego.Warn("Call AOS StartApp fail! err:", err)
-		this.Output(http.StatusInternalServerError, res)
+		beego.Warn("Select region fail, err:", err)
+		common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if success != true {
-		beego.Warn("Call AOS StartApp fail! status:", status)
-		this.Output(http.StatusInternalServerError, res)
+	stackName := aos.GetStackName(aos.INSTANCE_STACK_PREFIX, instanceName, instanceId)
+	//平台重试同一个实例时不重复创建
+	if this.provisionExisting(instanceId, &req, region.Name, token) {
 		return
 	}
-	//3. 响应
-	this.Output(http.StatusAccepted, res)
+	provisionReq := &provisioner.ProvisionRequest{
+		InstanceId: instanceId,
+		Name:       stackName,
+		LegacyName: aos.LegacyStackName(aos.INSTANCE_STACK_PREFIX, req.InstanceName, instanceId),
+		Region:     region.Name,
+		SpaceGuid:  req.SpaceGuid,
+		Plan:       plan,
+		Parameters: req.Parameters,
+		Token:      token,
+	}
+	appId, err := p.Provision(provisionReq)
+	stackName = provisionReq.Name
+	if err != nil {
+		beego.Warn("Provision instance "+instanceId+" fail! err:", err)
+		code, errRes := common.ErrorResponseOf(common.MapBackendError(err, provisionErrors), "Provision instance fail! ")
+		//后端资源未能回收时保留失败的实例记录, 平台可以据此删除
+		if appId != "" {
+			inst := newInstance(instanceId, stackName, appId, region.Name, &req)
+			inst.Backend = p.Type()
+			inst.StartOperation(store.OPERATION_CREATE)
+			inst.FinishOperation(store.STATE_FAILED, err.Error())
+			if err = this.Store.Put(inst); err != nil {
+				beego.Error("Save instance "+instanceId+" fail! err:", err)
+			}
+		}
+		usable := false
+		errRes.InstanceUsable = &usable
+		common.OutputErrorResponse(this.Ctx, code, errRes)
+		return
+	}
+	//记录实例, 后续请求不带 userdata 时据此找到后端资源
+	inst := newInstance(instanceId, stackName, appId, region.Name, &req)
+	inst.Backend = p.Type()
+	inst.StartOperation(store.OPERATION_CREATE)
+	if err = this.Store.Put(inst); err != nil {
+		//没有记录的 stack 会被对账当作孤儿删除, 因此先回收后端资源, 由平台重试
+		beego.Error("Save instance "+instanceId+" fail, deprovision app "+appId+", err:", err)
+		if derr := p.Deprovision(inst, token); derr != nil {
+			beego.Error("Deprovision app "+appId+" of instance "+instanceId+" fail! err:", derr)
+		}
+		common.OutputErrorWithCode(this.Ctx, "Save instance fail! "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	this.Tracker.Watch(instanceId, token)
+	this.Output(http.StatusAccepted, this.instanceResponse(inst))
 }
 
 //删除 service_instances
 func (this *Controller) DeleteInstance() {
 	//调用AOS的API，销毁实例
 	token := this.Ctx.Input.Header("X-Auth-Token")
-	var req Userdatas
-	//解析请求
-	err := json.Unmarshal([]byte(this.Ctx.Input.RequestBody), &req)
-	if err != nil {
-		beego.Warn("Unmarshal delete request body fail, err:", err)
-		common.OutputErrorWithCode(this.Ctx, "Unmarshal request body fail", http.StatusBadRequest)
-		return
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	var req models.Userdatas
+	//解析请求, OSB 的删除请求可以没有 body
+	if len(this.Ctx.Input.RequestBody) > 0 {
+		err := json.Unmarshal([]byte(this.Ctx.Input.RequestBody), &req)
+		if err != nil {
+			beego.Warn("Unmarshal delete request body fail, err:", err)
+			common.OutputErrorWithCode(this.Ctx, "Unmarshal request body fail", http.StatusBadRequest)
+			return
+		}
 	}
 	//
-	appID := req.Userdata
-	status, success, err := aos.DeleteApp(appID, token)
+	inst, _, err := this.loadInstance(instanceId, req.Userdata)
 	if err != nil {
-		beego.Warn("Call AOS DeleteApp fail! err:", err)
-		common.OutputError(this.Ctx, err, "Call AOS DeleteApp fail! ")
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusGone)
 		return
 	}
-	if success != true {
-		beego.Warn("Call AOS DeleteApp fail! status:", status)
-		common.OutputError(this.Ctx, err, "Call AOS DeleteApp fail! ")
+	p, ok := this.provisionerOf(inst)
+	if !ok {
 		return
 	}
-	this.Output(http.StatusAccepted, "delete asyn")
+	if err = p.Deprovision(inst, token); err != nil {
+		common.OutputError(this.Ctx, common.MapBackendError(err, deleteErrors), "Deprovision instance fail! ")
+		return
+	}
+	startedAt := this.startOperation(instanceId, store.OPERATION_DELETE)
+	this.Tracker.Watch(instanceId, token)
+	this.Output(http.StatusAccepted, models.OperationResp{
+		Operation: operationToken(store.OPERATION_DELETE, inst, startedAt),
+	})
 }
 
-//新建 service_bindings
+//新建 service_bindings, 平台带 accepts_incomplete=true 时异步执行
 func (this *Controller) CreateBinding() {
-	var req CreateBindReq
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	bindingId := this.Ctx.Input.Param(":binding_id")
+	var req models.CreateBindReq
 	err := json.Unmarshal([]byte(this.Ctx.Input.RequestBody), &req)
 	if err != nil {
 		beego.Warn("Unmarshal CreateBinding request body fail, err:", err)
 		common.OutputErrorWithCode(this.Ctx, "Unmarshal CreateBinding request body fail", http.StatusBadRequest)
 		return
 	}
-	//这里要返回使用服务实例的账号。example直接给个fake的
-	var res CreateBindResp
-	credential := make(map[string]interface{})
-	credential["username"] = "testUser"
-	credential["paasword"] = "testPassword"
-	res.Credentials = credential
+	if !this.validate(&req) {
+		return
+	}
+	service, plan, ok := this.Catalog.Plan(req.ServiceId, req.PlanId)
+	if !ok {
+		beego.Warn("Unknown service_id or plan_id:", req.ServiceId, req.PlanId)
+		common.OutputErrorWithCode(this.Ctx, "unknown service_id "+req.ServiceId+" or plan_id "+req.PlanId, http.StatusBadRequest)
+		return
+	}
+	if !service.IsBindable(plan) {
+		beego.Warn("Plan " + plan.Name + " of service " + service.Name + " is not bindable")
+		common.OutputErrorWithCode(this.Ctx, "plan "+req.PlanId+" is not bindable", http.StatusBadRequest)
+		return
+	}
+	//按 plan 的 schemas 校验参数
+	if err = plan.ValidateBindParameters(req.Parameters); err != nil {
+		beego.Warn("Validate bind parameters fail, err:", err)
+		common.OutputError(this.Ctx, err, "")
+		return
+	}
+	inst, stored, err := this.loadInstance(instanceId, req.Userdata)
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusNotFound)
+		return
+	}
+	p, ok := this.provisionerOf(inst)
+	if !ok {
+		return
+	}
+	var res models.CreateBindResp
 	res.Userdata = req.Userdata
-	this.Output(http.StatusOK, res)
+	//同一实例到同一应用的多个绑定在 BIND_SERVICES 中各占一个条目, 解绑时只移除自己的条目
+	b := &store.Binding{
+		BindingId:  bindingId,
+		AppGuid:    req.BoundAppGuid(),
+		EnvName:    bindingId,
+		Parameters: req.Parameters,
+		CreatedAt:  time.Now(),
+	}
+	//早期创建的实例不在存储中, 先记录该实例, 解绑时才能找到绑定记录
+	if !stored {
+		inst.ServiceId, inst.PlanId = req.ServiceId, req.PlanId
+		if err = this.Store.Put(inst); err != nil {
+			beego.Error("Save instance "+instanceId+" fail! err:", err)
+			common.OutputError(this.Ctx, err, "Save instance fail! ")
+			return
+		}
+	}
+	//同一个绑定重复提交时返回已保存的凭据, 异步创建失败的绑定重新创建
+	if existing, ok := inst.Bindings[bindingId]; ok && !existing.Failed() {
+		if existing.AppGuid != b.AppGuid || !sameParameters(existing.Parameters, req.Parameters) {
+			common.OutputErrorWithCode(this.Ctx, "binding "+bindingId+" already exists with different attributes", http.StatusConflict)
+			return
+		}
+		if existing.InProgress() {
+			this.Output(http.StatusAccepted, res)
+			return
+		}
+		res.Credentials = existing.Credentials
+		this.Output(http.StatusOK, res)
+		return
+	}
+	token := this.Ctx.Input.Header("X-Auth-Token")
+	//异步绑定: 先记录进行中的绑定, 后台完成后更新状态, 平台通过绑定的 last_operation 查询结果
+	if this.acceptsIncomplete() {
+		b.StartOperation(store.OPERATION_CREATE)
+		if err = saveBinding(this.Store, instanceId, b); err != nil {
+			beego.Error("Save binding "+bindingId+" fail! err:", err)
+			common.OutputError(this.Ctx, err, "Save binding fail! ")
+			return
+		}
+		this.Tracker.RunBinding(instanceId, bindingId, token)
+		this.Output(http.StatusAccepted, res)
+		return
+	}
+	credentials, err := p.Bind(inst, service, plan, b, token)
+	if err != nil {
+		common.OutputError(this.Ctx, common.MapBackendError(err, bindErrors), "Create binding fail! ")
+		return
+	}
+	b.Credentials = credentials
+	if err = saveBinding(this.Store, instanceId, b); err != nil {
+		//没有记录的绑定无法解绑, 回收后由平台重试
+		beego.Error("Save binding "+bindingId+" fail, unbind it, err:", err)
+		if uerr := p.Unbind(inst, service, plan, b, token); uerr != nil {
+			beego.Error("Unbind binding "+bindingId+" fail! err:", uerr)
+		}
+		common.OutputErrorWithCode(this.Ctx, "Save binding fail! "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Credentials = credentials
+	this.Output(http.StatusCreated, res)
 }
 
-//删除 service_bindings
+//删除 service_bindings, 平台带 accepts_incomplete=true 时异步执行
 func (this *Controller) DeleteBinding() {
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	bindingId := this.Ctx.Input.Param(":binding_id")
+	inst, err := this.Store.Get(instanceId)
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusGone)
+		return
+	}
+	b, ok := inst.Bindings[bindingId]
+	if !ok {
+		common.OutputErrorWithCode(this.Ctx, "binding "+bindingId+" not found", http.StatusGone)
+		return
+	}
+	if b.InProgress() {
+		if b.Operation.Kind == store.OPERATION_DELETE {
+			this.Output(http.StatusAccepted, struct{}{})
+			return
+		}
+		common.OutputErrorResponse(this.Ctx, http.StatusUnprocessableEntity, models.ErrorResponse{
+			Error:       common.ERROR_CONCURRENCY,
+			Description: "binding " + bindingId + " is being created",
+		})
+		return
+	}
+	p, ok := this.provisionerOf(inst)
+	if !ok {
+		return
+	}
+	//plan 已从 catalog 中移除时 plan 为 nil
+	service, plan, _ := this.Catalog.Plan(inst.ServiceId, inst.PlanId)
+	token := this.Ctx.Input.Header("X-Auth-Token")
+	if this.acceptsIncomplete() {
+		b.StartOperation(store.OPERATION_DELETE)
+		if err = saveBinding(this.Store, instanceId, b); err != nil {
+			beego.Error("Save binding "+bindingId+" fail! err:", err)
+			common.OutputError(this.Ctx, err, "Save binding fail! ")
+			return
+		}
+		this.Tracker.RunBinding(instanceId, bindingId, token)
+		this.Output(http.StatusAccepted, struct{}{})
+		return
+	}
+	if err = p.Unbind(inst, service, plan, b, token); err != nil {
+		common.OutputError(this.Ctx, common.MapBackendError(err, deleteErrors), "Delete binding fail! ")
+		return
+	}
+	err = this.Store.Update(instanceId, func(inst *store.Instance) error {
+		delete(inst.Bindings, bindingId)
+		return nil
+	})
+	if err != nil {
+		beego.Error("Remove binding "+bindingId+" fail! err:", err)
+	}
 	// |200 OK     |Binding was deleted
-	this.Output(http.StatusOK, "Binding was deleted")
+	this.Output(http.StatusOK, struct{}{})
+}
+
+//查询 service_instances, 需要 catalog 中设置 instances_retrievable
+func (this *Controller) GetInstance() {
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	inst, err := this.Store.Get(instanceId)
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusNotFound)
+		return
+	}
+	service, ok := this.Catalog.Service(inst.ServiceId)
+	if !ok || !service.InstancesRetrievable {
+		common.OutputErrorWithCode(this.Ctx, "service "+inst.ServiceId+" does not support fetching instances", http.StatusBadRequest)
+		return
+	}
+	if op := inst.LastOperation(); op != nil && op.State == store.STATE_IN_PROGRESS {
+		if op.Kind == store.OPERATION_CREATE {
+			common.OutputErrorWithCode(this.Ctx, "instance "+instanceId+" is being provisioned", http.StatusNotFound)
+			return
+		}
+		if op.Kind == store.OPERATION_UPDATE {
+			common.OutputErrorResponse(this.Ctx, http.StatusUnprocessableEntity, models.ErrorResponse{
+				Error:       common.ERROR_CONCURRENCY,
+				Description: "instance " + instanceId + " is being updated",
+			})
+			return
+		}
+	}
+	this.Output(http.StatusOK, models.GetInstResp{
+		ServiceId:    inst.ServiceId,
+		PlanId:       inst.PlanId,
+		DashboardUrl: inst.DashboardUrl,
+		Parameters:   inst.Parameters,
+	})
+}
+
+//查询 service_bindings, 需要 catalog 中设置 bindings_retrievable; 正在创建的绑定视为不存在
+func (this *Controller) GetBinding() {
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	bindingId := this.Ctx.Input.Param(":binding_id")
+	inst, err := this.Store.Get(instanceId)
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusNotFound)
+		return
+	}
+	service, ok := this.Catalog.Service(inst.ServiceId)
+	if !ok || !service.BindingsRetrievable {
+		common.OutputErrorWithCode(this.Ctx, "service "+inst.ServiceId+" does not support fetching bindings", http.StatusBadRequest)
+		return
+	}
+	b, ok := inst.Bindings[bindingId]
+	if !ok || b.Failed() || (b.InProgress() && b.Operation.Kind == store.OPERATION_CREATE) {
+		common.OutputErrorWithCode(this.Ctx, "binding "+bindingId+" not found", http.StatusNotFound)
+		return
+	}
+	this.Output(http.StatusOK, models.GetBindResp{
+		Credentials: b.Credentials,
+		Parameters:  b.Parameters,
+	})
+}
+
+//异步查询 service_bindings last_operation, 绑定已删除时返回 410
+func (this *Controller) BindingLastOperation() {
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	bindingId := this.Ctx.Input.Param(":binding_id")
+	inst, err := this.Store.Get(instanceId)
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusGone)
+		return
+	}
+	b, ok := inst.Bindings[bindingId]
+	if !ok {
+		common.OutputErrorWithCode(this.Ctx, "binding "+bindingId+" not found", http.StatusGone)
+		return
+	}
+	var res models.LastOperationRsp
+	res.State = store.STATE_SUCCEEDED
+	if b.Operation != nil {
+		res.State = b.Operation.State
+		res.Description = b.Operation.Description
+	}
+	this.Output(http.StatusOK, res)
 }
 
 //更新 service_instance
 func (this *Controller) UpdateInstance() {
-	var req UpdateInstReq
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	var req models.UpdateInstReq
 	err := json.Unmarshal([]byte(this.Ctx.Input.RequestBody), &req)
 	if err != nil {
 		beego.Warn("Unmarshal UpdateInstance request body fail, err:", err)
 		common.OutputErrorWithCode(this.Ctx, "Unmarshal UpdateInstance request body fail", http.StatusBadRequest)
 		return
 	}
+	if !this.validate(&req) {
+		return
+	}
 	beego.Info("UpdateInstance request: ", req)
+	//更换 plan 时只允许同一个 AOS 模板内的 plan; 原 plan 以实例记录为准, 没有记录时使用 previous_values
+	var previousPlanId string
+	if inst, err := this.Store.Get(instanceId); err == nil {
+		previousPlanId = inst.PlanId
+	} else if req.PreviousValues != nil {
+		previousPlanId = req.PreviousValues.PlanId
+	}
+	planId := req.PlanId
+	if planId == "" {
+		planId = previousPlanId
+	}
+	//不知道实例的 plan 时无法按 schemas 校验参数
+	if planId == "" && len(req.Parameters) > 0 {
+		beego.Warn("Plan of instance " + instanceId + " is unknown, can not validate parameters")
+		common.OutputErrorWithCode(this.Ctx, "plan of instance "+instanceId+" is unknown, plan_id or previous_values.plan_id is required to update parameters", http.StatusBadRequest)
+		return
+	}
+	pMap := req.Parameters
+	if planId != "" {
+		service, plan, ok := this.Catalog.Plan(req.ServiceId, planId)
+		if !ok {
+			beego.Warn("Unknown service_id or plan_id:", req.ServiceId, planId)
+			common.OutputErrorWithCode(this.Ctx, "unknown service_id "+req.ServiceId+" or plan_id "+planId, http.StatusBadRequest)
+			return
+		}
+		if previousPlanId != "" && previousPlanId != planId {
+			_, previous, ok := this.Catalog.Plan(req.ServiceId, previousPlanId)
+			if ok && !service.IsPlanUpdateable(previous) {
+				beego.Warn("Plan " + previous.Name + " of service " + service.Name + " is not updateable")
+				common.OutputErrorWithCode(this.Ctx, "plan "+previousPlanId+" does not support changing plan", http.StatusBadRequest)
+				return
+			}
+			if !ok || previous.BlueprintId != plan.BlueprintId || previous.Backend != plan.Backend {
+				beego.Warn("Change plan across blueprints is not supported:", previousPlanId, planId)
+				common.OutputErrorWithCode(this.Ctx, "plan "+planId+" uses a different blueprint, change plan is not supported", http.StatusBadRequest)
+				return
+			}
+			//更换 plan 时新 plan 的默认参数一并下发, 同名参数以用户参数为准
+			pMap = plan.Inputs(req.Parameters)
+		}
+		//按 plan 的 schemas 校验参数
+		if err = plan.ValidateUpdateParameters(req.Parameters); err != nil {
+			beego.Warn("Validate update parameters fail, err:", err)
+			common.OutputError(this.Ctx, err, "")
+			return
+		}
+	}
 	//1. 构造参数
+	inst, _, err := this.loadInstance(instanceId, req.Userdata)
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusNotFound)
+		return
+	}
+	p, ok := this.provisionerOf(inst)
+	if !ok {
+		return
+	}
 	token := this.Ctx.Input.Header("X-Auth-Token")
-	appId := req.Userdata
-	beego.Info(fmt.Printf("UpdateInstance request token:%d, appid:%s", len(token), appId))
-	pMap := req.Parameters
+	beego.Info("UpdateInstance request token length:", len(token), ", appid:", inst.AppId)
 	/* 目前只做了实例扩容
 	if pMap != nil && len(pMap) > 0 {
 		instanceNum, ok := pMap["instanceNum"].(string)
@@ -147,99 +568,161 @@ func (this *Controller) UpdateInstance() {
 			beego.Info("Broker ScaleAppInstances success: ", success)
 		}
 	}*/
-	// 支持所有参数的更新 by wxy
-	if pMap != nil && len(pMap) > 0 {
-		//2. 调用AOS实例扩容接口
-		success, err := aos.UpdateInstancesInputs(appId, token, pMap)
-		if err != nil {
-			beego.Error("call Broker UpdateInstancesInputs error, error is: ", err)
+	//2. 更新后端实例的参数
+	if err = p.Update(inst, pMap, token); err != nil {
+		common.OutputError(this.Ctx, common.MapBackendError(err, updateErrors), "Update instance fail! ")
+		return
+	}
+	startedAt := time.Now()
+	err = this.Store.Update(instanceId, func(inst *store.Instance) error {
+		if req.PlanId != "" {
+			inst.PlanId = req.PlanId
+		}
+		if inst.Parameters == nil {
+			inst.Parameters = make(map[string]interface{})
+		}
+		for k, v := range req.Parameters {
+			inst.Parameters[k] = v
 		}
-		beego.Info("Broker UpdateInstances success: ", success)
+		startedAt = inst.StartOperation(store.OPERATION_UPDATE).StartedAt
+		return nil
+	})
+	if err != nil && err != store.ErrNotFound {
+		beego.Error("Save instance "+instanceId+" fail! err:", err)
+	}
+	if err == nil {
+		this.Tracker.Watch(instanceId, token)
 	}
 	//3. 响应
-	var res CreateInstResp
-	res.Userdata = appId
-	res.BaseInfo.ActualId = appId
-	res.BaseInfo.InstanceType = "aos"
+	var res models.CreateInstResp
+	res.Userdata = this.Regions.Userdata(inst.Region, inst.AppId)
+	res.BaseInfo.ActualId = inst.AppId
+	res.BaseInfo.InstanceType = p.Type()
+	res.Operation = operationToken(store.OPERATION_UPDATE, inst, startedAt)
 	beego.Info("UpdateInstance resp:", res)
 	this.Output(http.StatusAccepted, res)
 }
-func getDashboard(appId, token string) string {
-	// 获取服务的URI后缀
-	uri := beego.AppConfig.String("service_uri")
-	//访问路径
-	dashboardUrl, err := aos.GetDashboardUrl(appId, token)
-	if err != nil {
-		beego.Warn("app getDashboard failed, error is: ", err)
-	} else {
-		//这里是根据Blueprint中的output章节的内容获取的:针对Container的应用这里怎么取到nodePort待确认
-		//ips, _ := outputs["hostip"].([]interface{})
-		//ip, _ := ips[0].(string)
-		//res.Dashboard_url = "http://" + ip + ":31108/v1/vmall"
-		dashboardUrl = "http://" + dashboardUrl + uri
-	}
-	return dashboardUrl
-}
 
 //异步查询服务实例 last_operation
 func (this *Controller) LastOpertaion() {
-	// 查询AOS接口，判断实例是否启动OK
-	token := this.Ctx.Input.Header("X-Auth-Token")
-	appId := this.Ctx.Input.Query("userdata")
+	instanceId := this.Ctx.Input.Param(":instance_id")
+	userdata := this.Ctx.Input.Query("userdata")
 	operate := this.Ctx.Input.Query("operation")
-	//创建or删除
-	var res LastOperationRsp
-	res.Userdata = appId
-	beego.Info("res.Userdata:", res.Userdata)
-	if operate == "create" {
-		appStatus, err := aos.QueryAppStatus(appId, token)
+	var res models.LastOperationRsp
+	res.Userdata = userdata
+	//operation 为异步响应返回的 token 时从中解析操作类型和 AOS app, 兼容早期的 create/update/delete
+	var opToken *models.OperationToken
+	if operate != "" && !models.IsLegacyOperation(operate) {
+		t, err := models.DecodeOperationToken(operate)
 		if err != nil {
-			beego.Warn("Query app status failed, error is: ", err)
-			res.State = aos.INSTANCE_IN_PROGRESS
-		} else if appStatus == aos.RUNNING {
-			res.State = aos.INSTANCE_SUCCEEDED
-			res.Dashboard_url = getDashboard(appId, token)
-		} else if appStatus == aos.ABNORMAL {
-			res.State = aos.INSTANCE_FAILED
-			beego.Error(appStatus)
-			this.Output(http.StatusInternalServerError, res)
+			beego.Warn("Decode operation of instance "+instanceId+" fail, err:", err)
+			common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusBadRequest)
 			return
-		} else {
-			res.State = aos.INSTANCE_IN_PROGRESS
-			beego.Debug(appStatus)
 		}
-	} else if operate == "delete" {
-		success, err := aos.CheckAppDeleteSuccess(appId, token)
-		if err != nil {
-			beego.Warn("Check app delete status failed, error is: ", err)
-			res.State = aos.INSTANCE_IN_PROGRESS
-		} else if success == true {
-			res.State = aos.INSTANCE_SUCCEEDED
-		} else {
-			res.State = aos.INSTANCE_IN_PROGRESS
-		}
-	} else if operate == "update" {
-		appStatus, err := aos.QueryAppStatus(appId, token)
-		if err != nil {
-			beego.Warn("Query app status failed, error is: ", err)
-			res.State = aos.INSTANCE_IN_PROGRESS
-		} else if appStatus == aos.RUNNING {
-			res.Dashboard_url = getDashboard(appId, token)
-			res.State = aos.INSTANCE_SUCCEEDED
-		} else if appStatus == aos.ABNORMAL {
-			res.State = aos.INSTANCE_FAILED
-			beego.Error(appStatus)
-			this.Output(http.StatusInternalServerError, res)
+		opToken = &t
+		operate = t.Kind
+	}
+	//实例存储中有该操作时直接返回后台跟踪的状态, 平台未指定操作时以最近一次操作为准
+	if inst, err := this.Store.Get(instanceId); err == nil && inst.LastOperation() != nil {
+		op := inst.LastOperation()
+		if operate == "" || (operate == op.Kind && (opToken == nil || opToken.StartedAt == op.StartedAt.UnixNano())) {
+			this.outputOperation(inst, op, res)
 			return
+		}
+	}
+	// 查询实例的后端; 实例存储中没有该操作, 不更新存储
+	var inst *store.Instance
+	var err error
+	if opToken != nil {
+		//operation 由平台带回, 其中的 app 与实例记录一致时才按存储中的实例处理
+		inst = &store.Instance{InstanceId: instanceId, AppId: opToken.AppId, Region: opToken.Region, Backend: opToken.Backend, Transient: true}
+		if stored, err := this.Store.Get(instanceId); err == nil && stored.AppId == opToken.AppId && stored.Region == opToken.Region {
+			inst = stored
+		}
+	} else {
+		inst, _, err = this.loadInstance(instanceId, userdata)
+	}
+	if err != nil {
+		beego.Warn("Load instance "+instanceId+" fail, err:", err)
+		this.outputResolveError(err, http.StatusGone)
+		return
+	}
+	if _, ok := this.provisionerOf(inst); !ok {
+		return
+	}
+	beego.Info("res.Userdata:", res.Userdata)
+	//与后台跟踪相同: 查询失败时报告进行中, 连续失败次数达到上限或超时后报告失败, 避免平台无限轮询
+	var startedAt time.Time
+	if opToken != nil {
+		startedAt = time.Unix(0, opToken.StartedAt)
+	}
+	status := this.Tracker.Query(inst, operate, this.Ctx.Input.Header("X-Auth-Token"), startedAt)
+	res.State = status.State
+	res.Description = status.Description
+	res.Dashboard_url = status.DashboardUrl
+	switch status.State {
+	case store.STATE_IN_PROGRESS:
+		this.Ctx.Output.Header("Retry-After", strconv.Itoa(this.Tracker.RetryAfter(instanceId)))
+	case store.STATE_FAILED:
+		beego.Error("Operation "+operate+" of instance "+instanceId+" failed:", status.Description)
+	}
+	beego.Info("resp:", res)
+	this.Output(http.StatusOK, res)
+}
+
+// 按实例存储中的操作状态输出 last_operation 响应, 进行中时带 Retry-After
+func (this *Controller) outputOperation(inst *store.Instance, op *store.Operation, res models.LastOperationRsp) {
+	res.State = op.State
+	res.Description = op.Description
+	switch op.State {
+	case store.STATE_IN_PROGRESS:
+		//broker 重启后由平台的轮询恢复跟踪
+		this.Tracker.Watch(inst.InstanceId, this.Ctx.Input.Header("X-Auth-Token"))
+		this.Ctx.Output.Header("Retry-After", strconv.Itoa(this.Tracker.RetryAfter(inst.InstanceId)))
+	case store.STATE_SUCCEEDED:
+		if op.Kind == store.OPERATION_DELETE {
+			if err := this.Store.Delete(inst.InstanceId); err != nil {
+				beego.Error("Remove instance "+inst.InstanceId+" fail! err:", err)
+			}
 		} else {
-			res.State = aos.INSTANCE_IN_PROGRESS
-			beego.Debug(appStatus)
+			res.Dashboard_url = inst.DashboardUrl
 		}
+	case store.STATE_FAILED:
+		beego.Error("Operation "+op.Kind+" of instance "+inst.InstanceId+" failed:", op.Description)
 	}
 	beego.Info("resp:", res)
 	this.Output(http.StatusOK, res)
 }
 
+//查询最近一次对账结果
+func (this *Controller) GetReconcileReport() {
+	if !this.checkAdmin() {
+		return
+	}
+	report := this.Reconciler.LastReport()
+	if report == nil {
+		common.OutputErrorWithCode(this.Ctx, "reconcile has not run yet", http.StatusNotFound)
+		return
+	}
+	this.Output(http.StatusOK, report)
+}
+
+//立即执行一次对账, 同时返回需要运维处理的 stack 记录
+func (this *Controller) Reconcile() {
+	if !this.checkAdmin() {
+		return
+	}
+	report := this.Reconciler.Reconcile()
+	stacks, err := this.Store.ListStacks()
+	if err != nil {
+		beego.Error("List stack records fail! err:", err)
+	}
+	this.Output(http.StatusOK, struct {
+		*reconciler.Report
+		Stacks []*store.StackRecord `json:"recorded_stacks,omitempty"`
+	}{report, stacks})
+}
+
 //自定义订购页面
 func (this *Controller) ProvisionWeb() {
 	//
@@ -265,6 +748,195 @@ func (this *Controller) UpdateWeb() {
 }
 
 //-------------------------
+// 从实例存储中查找实例, stored 表示存储中有该实例. 存储中有记录时以记录为准, 平台带的 userdata 与记录不一致时返回 errUserdataMismatch;
+// 没有记录时(例如早期创建的实例)按 userdata 构造一个临时实例
+func (this *Controller) loadInstance(instanceId, userdata string) (inst *store.Instance, stored bool, err error) {
+	inst, err = this.Store.Get(instanceId)
+	if err == nil {
+		if userdata != "" {
+			region, appId, err := this.Regions.Resolve(userdata)
+			if err != nil || this.Regions.Userdata(region.Name, appId) != this.Regions.Userdata(inst.Region, inst.AppId) {
+				beego.Warn("Userdata " + userdata + " does not match instance " + instanceId)
+				return nil, true, errUserdataMismatch
+			}
+		}
+		return inst, true, nil
+	}
+	if err != store.ErrNotFound || userdata == "" {
+		return nil, false, err
+	}
+	region, appId, err := this.Regions.Resolve(userdata)
+	if err != nil {
+		return nil, false, err
+	}
+	return &store.Instance{InstanceId: instanceId, AppId: appId, Region: region.Name, Transient: true}, false, nil
+}
+
+// 实例的后端, 找不到时输出 500 并返回 false
+func (this *Controller) provisionerOf(inst *store.Instance) (provisioner.Provisioner, bool) {
+	p, err := this.Provisioners.ForInstance(inst)
+	if err != nil {
+		beego.Error("Get backend of instance "+inst.InstanceId+" fail, err:", err)
+		common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return p, true
+}
+
+func newInstance(instanceId, stackName, appId, regionName string, req *models.CreateInstReq) *store.Instance {
+	return &store.Instance{
+		InstanceId:       instanceId,
+		ServiceId:        req.ServiceId,
+		PlanId:           req.PlanId,
+		OrganizationGuid: req.OrganizationGuid,
+		SpaceGuid:        req.SpaceGuid,
+		Context:          req.Context,
+		Parameters:       req.Parameters,
+		StackName:        stackName,
+		AppId:            appId,
+		Region:           regionName,
+	}
+}
+
+func (this *Controller) instanceResponse(inst *store.Instance) models.CreateInstResp {
+	var res models.CreateInstResp
+	res.Userdata = this.Regions.Userdata(inst.Region, inst.AppId)
+	res.BaseInfo.ActualId = inst.AppId
+	if p, err := this.Provisioners.ForInstance(inst); err == nil {
+		res.BaseInfo.InstanceType = p.Type()
+	}
+	res.BaseInfo.ActualName = inst.StackName
+	if op := inst.LastOperation(); op != nil && op.State == store.STATE_IN_PROGRESS {
+		res.Operation = operationToken(op.Kind, inst, op.StartedAt)
+	}
+	return res
+}
+
+// 异步响应中的 operation
+func operationToken(kind string, inst *store.Instance, startedAt time.Time) string {
+	t := models.NewOperationToken(kind, inst.AppId, inst.Region, startedAt)
+	t.Backend = inst.Backend
+	return t.Encode()
+}
+
+// 与已有实例的属性是否一致
+func sameProvision(inst *store.Instance, req *models.CreateInstReq, regionName string) bool {
+	if inst.ServiceId != req.ServiceId || inst.PlanId != req.PlanId || inst.Region != regionName ||
+		inst.OrganizationGuid != req.OrganizationGuid || inst.SpaceGuid != req.SpaceGuid {
+		return false
+	}
+	return sameParameters(inst.Parameters, req.Parameters)
+}
+
+func saveBinding(instances *store.Store, instanceId string, b *store.Binding) error {
+	return instances.Update(instanceId, func(inst *store.Instance) error {
+		if inst.Bindings == nil {
+			inst.Bindings = make(map[string]*store.Binding)
+		}
+		inst.Bindings[b.BindingId] = b
+		return nil
+	})
+}
+
+// 校验管理接口请求头中的 X-Admin-Token, 未配置 admin_token 时管理接口不可用
+func (this *Controller) checkAdmin() bool {
+	if this.AdminToken == "" {
+		common.OutputErrorWithCode(this.Ctx, "admin api is disabled", http.StatusNotFound)
+		return false
+	}
+	token := this.Ctx.Input.Header(ADMIN_TOKEN_HEADER)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(this.AdminToken)) != 1 {
+		beego.Warn("Reject admin request from", this.Ctx.Input.IP())
+		common.OutputErrorWithCode(this.Ctx, "invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// 平台是否接受异步响应
+func (this *Controller) acceptsIncomplete() bool {
+	return this.Ctx.Input.Query("accepts_incomplete") == "true"
+}
+
+// 参数为空与未传参数视为一致
+func sameParameters(a, b map[string]interface{}) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// 实例已存在时按 OSB 规范输出响应并返回 true: 属性相同且已创建完成返回 200, 属性相同且正在创建返回 202, 否则返回 409.
+// broker 中没有记录时由后端的 Provision 处理已存在的资源(例如上次创建后未来得及保存).
+func (this *Controller) provisionExisting(instanceId string, req *models.CreateInstReq, regionName, token string) bool {
+	inst, err := this.Store.Get(instanceId)
+	if err == store.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		beego.Error("Load instance "+instanceId+" fail! err:", err)
+		common.OutputError(this.Ctx, err, "Load instance fail! ")
+		return true
+	}
+	if !sameProvision(inst, req, regionName) {
+		beego.Warn("Instance " + instanceId + " already exists with different attributes")
+		common.OutputErrorWithCode(this.Ctx, "instance "+instanceId+" already exists with different attributes", http.StatusConflict)
+		return true
+	}
+	op := inst.LastOperation()
+	switch {
+	case op == nil:
+		this.Output(http.StatusOK, this.instanceResponse(inst))
+	case op.Kind == store.OPERATION_CREATE && op.State == store.STATE_IN_PROGRESS:
+		this.Tracker.Watch(instanceId, token)
+		this.Output(http.StatusAccepted, this.instanceResponse(inst))
+	case op.Kind == store.OPERATION_CREATE && op.State == store.STATE_FAILED:
+		common.OutputErrorWithCode(this.Ctx, "instance "+instanceId+" already exists and failed to provision", http.StatusConflict)
+	case op.Kind == store.OPERATION_DELETE:
+		common.OutputErrorWithCode(this.Ctx, "instance "+instanceId+" is being deleted", http.StatusConflict)
+	default:
+		this.Output(http.StatusOK, this.instanceResponse(inst))
+	}
+	return true
+}
+
+// 实例不存在时输出 notFoundCode, userdata 与实例记录不一致时输出 409, 其它错误输出 400
+func (this *Controller) outputResolveError(err error, notFoundCode int) {
+	if err == store.ErrNotFound {
+		common.OutputErrorWithCode(this.Ctx, err.Error(), notFoundCode)
+		return
+	}
+	if err == errUserdataMismatch {
+		common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusConflict)
+		return
+	}
+	common.OutputErrorWithCode(this.Ctx, err.Error(), http.StatusBadRequest)
+}
+
+// 记录新的操作, 返回操作开始时间
+func (this *Controller) startOperation(instanceId, kind string) time.Time {
+	startedAt := time.Now()
+	err := this.Store.Update(instanceId, func(inst *store.Instance) error {
+		startedAt = inst.StartOperation(kind).StartedAt
+		return nil
+	})
+	if err != nil && err != store.ErrNotFound {
+		beego.Error("Save "+kind+" operation of instance "+instanceId+" fail! err:", err)
+	}
+	return startedAt
+}
+
+// 校验请求, 不合法时输出 OSB 格式的 400 响应
+func (this *Controller) validate(req interface{ Validate() error }) bool {
+	err := req.Validate()
+	if err == nil {
+		return true
+	}
+	beego.Warn("Validate request fail, err:", err)
+	common.OutputError(this.Ctx, err, "")
+	return false
+}
+
 func (this *Controller) Output(statusCode int, data interface{}) {
 	this.Ctx.Output.SetStatus(statusCode)
 	var result []byte
@@ -279,6 +951,7 @@ func (this *Controller) Output(statusCode int, data interface{}) {
 // 查询实例状态
 func (this *Controller) GetInstanceStatus() {
 	token := this.Ctx.Input.Header("X-Auth-Token")
+	instanceId := this.Ctx.Input.Param(":instance_id")
 	//解析请求body 体
 	bodyBuffer, err := ioutil.ReadAll(this.Ctx.Request.Body)
 	if err != nil {
@@ -286,23 +959,27 @@ func (this *Controller) GetInstanceStatus() {
 		common.OutputErrorWithCode(this.Ctx, "request body invalid", http.StatusBadRequest)
 		return
 	}
-	appId := string(bodyBuffer)
-	beego.Info("userdata(appId) is: ", appId)
-	if appId == "" {
-		beego.Error("GetInstanceStatus app id in request body empty")
-		common.OutputErrorWithCode(this.Ctx, "request body invalid", http.StatusBadRequest)
+	userdata := string(bodyBuffer)
+	beego.Info("userdata(appId) is: ", userdata)
+	inst, _, err := this.loadInstance(instanceId, userdata)
+	if err != nil {
+		beego.Error("GetInstanceStatus load instance "+instanceId+" error: ", err)
+		this.outputResolveError(err, http.StatusGone)
+		return
+	}
+	p, ok := this.provisionerOf(inst)
+	if !ok {
 		return
 	}
-	status, err := aos.QueryAppStatus(appId, token)
+	status, err := p.Status(inst, token)
 	if err != nil {
-		beego.Error("query app status from aos error: ", err)
+		beego.Error("query instance status from backend error: ", err)
 		this.Output(http.StatusInternalServerError, `{"status":"unavailable"}`)
 		return
 	}
-	beego.Info("app status from aos is: ", status)
-	if status == aos.RUNNING {
+	if status == provisioner.STATUS_AVAILABLE {
 		this.Output(http.StatusOK, `{"status":"available"}`)
-	} else if status == aos.APP_NOT_EXIST {
+	} else if status == provisioner.STATUS_NOT_EXIST {
 		this.Output(http.StatusGone, `{"status":"unavailable","message":"app not exist"}`)
 	} else {
 		this.Output(http.StatusOK, `{"status":"unavailable","message":"app status not ok"}`)
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego"
+	"service-broker/aos"
+	"service-broker/aostest"
+	"service-broker/catalog"
+	"service-broker/models"
+	"service-broker/provisioner"
+	"service-broker/reconciler"
+	"service-broker/store"
+	"service-broker/tracker"
+)
+
+const (
+	testRegion     = "r1"
+	testServiceId  = "service-1"
+	testPlanId     = "plan-small"
+	testInstanceId = "5b1a7c1e-6a3f-4b0a-9a6e-3c2f5e1d0a01"
+	testBindingId  = "binding-1"
+)
+
+const testCatalog = `
+services:
+- id: service-1
+  name: redis
+  description: redis
+  bindable: true
+  plan_updateable: true
+  instances_retrievable: true
+  bindings_retrievable: true
+  plans:
+  - id: plan-small
+    name: small
+    description: small
+    blueprint_id: blueprint-1
+    inputs_json:
+      memory: 256
+    binding:
+      strategy: outputs
+      outputs:
+        host: hostip
+        port: address_port
+  - id: plan-large
+    name: large
+    description: large
+    blueprint_id: blueprint-1
+    inputs_json:
+      memory: 1024
+      replicas: 2
+    binding:
+      strategy: outputs
+      outputs:
+        host: hostip
+        port: address_port
+`
+
+// 通过 httptest 调用 Controller 的 broker, 后端为 aostest
+type broker struct {
+	aos     *aostest.Server
+	store   *store.Store
+	regions *aos.Registry
+	handler http.Handler
+	header  http.Header // 每个请求都带上的请求头
+}
+
+func newBroker(t *testing.T, configure func(ctr *Controller)) *broker {
+	beego.BConfig.CopyRequestBody = true
+	beego.BConfig.WebConfig.AutoRender = false
+	dir, err := ioutil.TempDir("", "broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	instances, err := store.Open(filepath.Join(dir, "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instances.Close() })
+	server := aostest.NewServer()
+	t.Cleanup(server.Close)
+	regions, err := aos.NewRegistry(testRegion, server.Region(testRegion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := catalog.Parse([]byte(testCatalog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &provisioner.AOS{Regions: regions, Store: instances, RollbackTimeout: time.Second}
+	provisioners, err := provisioner.NewRegistry(provisioner.BACKEND_AOS, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := tracker.New(instances, provisioners, services, tracker.Options{Workers: 2, Interval: 10 * time.Millisecond, MaxInterval: 20 * time.Millisecond})
+	if err = operations.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctr := &Controller{Regions: regions, Catalog: services, Store: instances, Tracker: operations, Provisioners: provisioners,
+		Reconciler: reconciler.New(instances, regions, reconciler.Options{})}
+	if configure != nil {
+		configure(ctr)
+	}
+	handlers := beego.NewControllerRegister()
+	addRoutes(handlers, ctr)
+	return &broker{aos: server, store: instances, regions: regions, handler: handlers, header: http.Header{}}
+}
+
+func (b *broker) do(t *testing.T, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	for k, v := range b.header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	b.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+}
+
+func expectCode(t *testing.T, rec *httptest.ResponseRecorder, code int, what string) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("%s: status %d, want %d, body %s", what, rec.Code, code, rec.Body.String())
+	}
+}
+
+func instancePath(instanceId string) string {
+	return "/v2/service_instances/" + instanceId
+}
+
+func bindingPath(instanceId, bindingId string) string {
+	return instancePath(instanceId) + "/service_bindings/" + bindingId
+}
+
+func provisionRequest(planId string) models.CreateInstReq {
+	return models.CreateInstReq{ServiceId: testServiceId, PlanId: planId, OrganizationGuid: "org", SpaceGuid: "space"}
+}
+
+// 轮询 last_operation 直到操作结束
+func (b *broker) waitOperation(t *testing.T, path, operation string) models.LastOperationRsp {
+	t.Helper()
+	query := ""
+	if operation != "" {
+		query = "?operation=" + url.QueryEscape(operation)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rec := b.do(t, http.MethodGet, path+"/last_operation"+query, nil)
+		expectCode(t, rec, http.StatusOK, "last_operation")
+		var res models.LastOperationRsp
+		decode(t, rec, &res)
+		if res.State != store.STATE_IN_PROGRESS {
+			return res
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("operation of " + path + " did not finish")
+	return models.LastOperationRsp{}
+}
+
+// 创建实例并等待完成, 返回 AOS app id
+func (b *broker) provision(t *testing.T, instanceId string) string {
+	t.Helper()
+	rec := b.do(t, http.MethodPut, instancePath(instanceId)+"?accepts_incomplete=true", provisionRequest(testPlanId))
+	expectCode(t, rec, http.StatusAccepted, "provision")
+	var res models.CreateInstResp
+	decode(t, rec, &res)
+	if res := b.waitOperation(t, instancePath(instanceId), res.Operation); res.State != store.STATE_SUCCEEDED {
+		t.Fatalf("provision: %+v", res)
+	}
+	return res.BaseInfo.ActualId
+}
+
+func TestProvisionAndDeprovision(t *testing.T) {
+	b := newBroker(t, nil)
+	path := instancePath(testInstanceId)
+
+	rec := b.do(t, http.MethodPut, path+"?accepts_incomplete=true", provisionRequest(testPlanId))
+	expectCode(t, rec, http.StatusAccepted, "provision")
+	var created models.CreateInstResp
+	decode(t, rec, &created)
+	token, err := models.DecodeOperationToken(created.Operation)
+	if err != nil || token.Kind != store.OPERATION_CREATE || token.AppId != created.BaseInfo.ActualId || token.Region != testRegion {
+		t.Fatalf("operation token = %+v, %v", token, err)
+	}
+	if stack, ok := b.aos.Stack(created.BaseInfo.ActualId); !ok || stack.TemplateId != "blueprint-1" || stack.Inputs["memory"] != float64(256) {
+		t.Errorf("stack = %+v", stack)
+	}
+
+	//创建中重复提交返回 202, 属性不同返回 409
+	expectCode(t, b.do(t, http.MethodPut, path+"?accepts_incomplete=true", provisionRequest(testPlanId)), http.StatusAccepted, "repeated provision")
+	expectCode(t, b.do(t, http.MethodPut, path+"?accepts_incomplete=true", provisionRequest("plan-large")), http.StatusConflict, "conflicting provision")
+
+	res := b.waitOperation(t, path, created.Operation)
+	if res.State != store.STATE_SUCCEEDED || res.Dashboard_url == "" {
+		t.Fatalf("last_operation = %+v", res)
+	}
+	expectCode(t, b.do(t, http.MethodPut, path+"?accepts_incomplete=true", provisionRequest(testPlanId)), http.StatusOK, "provision after success")
+	rec = b.do(t, http.MethodGet, path, nil)
+	expectCode(t, rec, http.StatusOK, "get instance")
+	var inst models.GetInstResp
+	if decode(t, rec, &inst); inst.PlanId != testPlanId || inst.DashboardUrl != res.Dashboard_url {
+		t.Errorf("instance = %+v", inst)
+	}
+
+	rec = b.do(t, http.MethodDelete, path+"?accepts_incomplete=true&service_id="+testServiceId+"&plan_id="+testPlanId, nil)
+	expectCode(t, rec, http.StatusAccepted, "deprovision")
+	var deleted models.OperationResp
+	decode(t, rec, &deleted)
+	if token, err = models.DecodeOperationToken(deleted.Operation); err != nil || token.Kind != store.OPERATION_DELETE {
+		t.Fatalf("operation token = %+v, %v", token, err)
+	}
+	if res = b.waitOperation(t, path, deleted.Operation); res.State != store.STATE_SUCCEEDED {
+		t.Fatalf("last_operation = %+v", res)
+	}
+	if _, err = b.store.Get(testInstanceId); err != store.ErrNotFound {
+		t.Errorf("instance still stored after delete: %v", err)
+	}
+	expectCode(t, b.do(t, http.MethodDelete, path+"?accepts_incomplete=true", nil), http.StatusGone, "repeated deprovision")
+}
+
+func TestProvisionValidation(t *testing.T) {
+	b := newBroker(t, nil)
+	path := instancePath(testInstanceId) + "?accepts_incomplete=true"
+
+	req := provisionRequest(testPlanId)
+	req.SpaceGuid = ""
+	expectCode(t, b.do(t, http.MethodPut, path, req), http.StatusBadRequest, "provision without space_guid")
+	expectCode(t, b.do(t, http.MethodPut, path, provisionRequest("plan-unknown")), http.StatusBadRequest, "provision with unknown plan")
+	if n := len(b.aos.Stacks()); n != 0 {
+		t.Errorf("stacks = %d, want 0", n)
+	}
+}
+
+// 创建失败的实例: last_operation 以 200 返回 failed, 重复创建返回 409
+func TestProvisionFails(t *testing.T) {
+	b := newBroker(t, nil)
+	b.aos.Script(aostest.LIFECYCLE_CREATE, aostest.STATUS_PROCESSING, aostest.STATUS_ABNORMAL)
+	path := instancePath(testInstanceId)
+
+	rec := b.do(t, http.MethodPut, path+"?accepts_incomplete=true", provisionRequest(testPlanId))
+	expectCode(t, rec, http.StatusAccepted, "provision")
+	var created models.CreateInstResp
+	decode(t, rec, &created)
+	if res := b.waitOperation(t, path, created.Operation); res.State != store.STATE_FAILED {
+		t.Fatalf("last_operation = %+v", res)
+	}
+	expectCode(t, b.do(t, http.MethodPut, path+"?accepts_incomplete=true", provisionRequest(testPlanId)), http.StatusConflict, "provision after failure")
+}
+
+// 同一模板内更换 plan 时下发新 plan 的默认参数, 用户参数优先
+func TestUpdatePlan(t *testing.T) {
+	b := newBroker(t, nil)
+	appId := b.provision(t, testInstanceId)
+	path := instancePath(testInstanceId)
+
+	rec := b.do(t, http.MethodPatch, path+"?accepts_incomplete=true", models.UpdateInstReq{
+		ServiceId:  testServiceId,
+		PlanId:     "plan-large",
+		Parameters: map[string]interface{}{"memory": 2048},
+	})
+	expectCode(t, rec, http.StatusAccepted, "update")
+	var updated models.CreateInstResp
+	decode(t, rec, &updated)
+	if res := b.waitOperation(t, path, updated.Operation); res.State != store.STATE_SUCCEEDED {
+		t.Fatalf("last_operation = %+v", res)
+	}
+	stack, _ := b.aos.Stack(appId)
+	last := stack.Actions[len(stack.Actions)-1]
+	if last.Lifecycle != aostest.LIFECYCLE_UPGRADE || last.Inputs["memory"] != float64(2048) || last.Inputs["replicas"] != float64(2) {
+		t.Errorf("upgrade action = %+v", last)
+	}
+	if inst, _ := b.store.Get(testInstanceId); inst.PlanId != "plan-large" {
+		t.Errorf("plan = %s, want plan-large", inst.PlanId)
+	}
+}
+
+// 不知道实例的 plan 时不能按 schemas 校验参数
+func TestUpdateUnknownPlan(t *testing.T) {
+	b := newBroker(t, nil)
+	stack := b.aos.AddStack("legacy", "", aostest.STATUS_RUNNING)
+
+	rec := b.do(t, http.MethodPatch, instancePath(testInstanceId)+"?accepts_incomplete=true", models.UpdateInstReq{
+		ServiceId:  testServiceId,
+		Parameters: map[string]interface{}{"memory": 2048},
+		Userdata:   stack.Id,
+	})
+	expectCode(t, rec, http.StatusBadRequest, "update without plan")
+	if stack, _ = b.aos.Stack(stack.Id); len(stack.Actions) != 0 {
+		t.Errorf("actions = %+v", stack.Actions)
+	}
+}
+
+// 未记录在存储中的实例: 查询 AOS 失败时报告进行中, 失败状态以 200 返回
+func TestLastOperationUntracked(t *testing.T) {
+	b := newBroker(t, nil)
+	stack := b.aos.AddStack("legacy", "", aostest.STATUS_PROCESSING)
+	operation := models.NewOperationToken(store.OPERATION_CREATE, stack.Id, testRegion, time.Now()).Encode()
+	path := instancePath(testInstanceId) + "/last_operation?operation=" + url.QueryEscape(operation)
+
+	check := func(what, state string) {
+		t.Helper()
+		rec := b.do(t, http.MethodGet, path, nil)
+		expectCode(t, rec, http.StatusOK, what)
+		var res models.LastOperationRsp
+		if decode(t, rec, &res); res.State != state {
+			t.Errorf("%s: state = %s, want %s", what, res.State, state)
+		}
+		if retry := rec.Header().Get("Retry-After"); (retry != "") != (state == store.STATE_IN_PROGRESS) {
+			t.Errorf("%s: Retry-After = %q", what, retry)
+		}
+	}
+	check("processing", store.STATE_IN_PROGRESS)
+	b.aos.Inject(aostest.Failure{Op: aostest.OP_GET, StatusCode: http.StatusInternalServerError, Times: 1})
+	check("query error", store.STATE_IN_PROGRESS)
+	b.aos.SetStatus(stack.Id, aostest.STATUS_ABNORMAL)
+	check("abnormal", store.STATE_FAILED)
+	if _, err := b.store.Get(testInstanceId); err != store.ErrNotFound {
+		t.Errorf("untracked instance saved: %v", err)
+	}
+}
+
+// 异步绑定、轮询、解绑; 同一应用的两个绑定各占一个 BIND_SERVICES 条目
+func TestBindingFlow(t *testing.T) {
+	b := newBroker(t, nil)
+	b.provision(t, testInstanceId)
+	consumer := b.aos.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	bindReq := models.CreateBindReq{ServiceId: testServiceId, PlanId: testPlanId, BindResource: &models.BindResource{AppGuid: consumer.Id}}
+	path := bindingPath(testInstanceId, testBindingId)
+
+	expectCode(t, b.do(t, http.MethodPut, path+"?accepts_incomplete=true", bindReq), http.StatusAccepted, "async bind")
+	if res := b.waitOperation(t, path, ""); res.State != store.STATE_SUCCEEDED {
+		t.Fatalf("binding last_operation = %+v", res)
+	}
+	rec := b.do(t, http.MethodGet, path, nil)
+	expectCode(t, rec, http.StatusOK, "get binding")
+	var binding models.GetBindResp
+	if decode(t, rec, &binding); binding.Credentials["host"] != aostest.DEFAULT_HOST_IP {
+		t.Errorf("binding = %+v", binding)
+	}
+	rec = b.do(t, http.MethodPut, path+"?accepts_incomplete=true", bindReq)
+	expectCode(t, rec, http.StatusOK, "repeated bind")
+	other := bindReq
+	other.BindResource = &models.BindResource{AppGuid: "other-app"}
+	expectCode(t, b.do(t, http.MethodPut, path, other), http.StatusConflict, "conflicting bind")
+
+	//同步绑定第二个绑定
+	second := bindingPath(testInstanceId, "binding-2")
+	expectCode(t, b.do(t, http.MethodPut, second, bindReq), http.StatusCreated, "sync bind")
+	if entries := bindServices(t, b.aos, consumer.Id); len(entries) != 2 {
+		t.Fatalf("BIND_SERVICES = %+v", entries)
+	}
+
+	expectCode(t, b.do(t, http.MethodDelete, path+"?accepts_incomplete=true", nil), http.StatusAccepted, "async unbind")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec = b.do(t, http.MethodGet, path+"/last_operation", nil)
+		if rec.Code == http.StatusGone {
+			break
+		}
+		expectCode(t, rec, http.StatusOK, "binding last_operation")
+		if time.Now().After(deadline) {
+			t.Fatal("unbind did not finish: " + rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := bindServices(t, b.aos, consumer.Id)
+	if len(entries) != 1 || entries[0].Name != "binding-2" {
+		t.Fatalf("BIND_SERVICES after unbind = %+v", entries)
+	}
+	expectCode(t, b.do(t, http.MethodDelete, second, nil), http.StatusOK, "sync unbind")
+	expectCode(t, b.do(t, http.MethodDelete, second, nil), http.StatusGone, "repeated unbind")
+	if entries = bindServices(t, b.aos, consumer.Id); len(entries) != 0 {
+		t.Errorf("BIND_SERVICES after unbind = %+v", entries)
+	}
+}
+
+// 早期实例不在存储中, 绑定后可以解绑
+func TestBindLegacyInstance(t *testing.T) {
+	b := newBroker(t, nil)
+	stack := b.aos.AddStack("legacy", "", aostest.STATUS_RUNNING)
+	consumer := b.aos.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	path := bindingPath(testInstanceId, testBindingId)
+
+	rec := b.do(t, http.MethodPut, path, models.CreateBindReq{ServiceId: testServiceId, PlanId: testPlanId, AppGuid: consumer.Id, Userdata: stack.Id})
+	expectCode(t, rec, http.StatusCreated, "bind legacy instance")
+	if entries := bindServices(t, b.aos, consumer.Id); len(entries) != 1 {
+		t.Fatalf("BIND_SERVICES = %+v", entries)
+	}
+	expectCode(t, b.do(t, http.MethodDelete, path, nil), http.StatusOK, "unbind legacy instance")
+	if entries := bindServices(t, b.aos, consumer.Id); len(entries) != 0 {
+		t.Errorf("BIND_SERVICES after unbind = %+v", entries)
+	}
+}
+
+// 正在创建的绑定不能解绑
+func TestUnbindWhileBinding(t *testing.T) {
+	b := newBroker(t, nil)
+	b.provision(t, testInstanceId)
+	err := b.store.Update(testInstanceId, func(inst *store.Instance) error {
+		binding := &store.Binding{BindingId: testBindingId, EnvName: testBindingId}
+		binding.StartOperation(store.OPERATION_CREATE)
+		inst.Bindings = map[string]*store.Binding{testBindingId: binding}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := b.do(t, http.MethodDelete, bindingPath(testInstanceId, testBindingId)+"?accepts_incomplete=true", nil)
+	expectCode(t, rec, http.StatusUnprocessableEntity, "unbind while binding")
+	var res models.ErrorResponse
+	if decode(t, rec, &res); res.Error != "ConcurrencyError" {
+		t.Errorf("error = %+v", res)
+	}
+}
+
+// 配置了 broker 凭据时 OSB 接口需要 basic auth, 健康检查不需要
+func TestBasicAuth(t *testing.T) {
+	b := newBroker(t, func(ctr *Controller) {
+		ctr.BrokerUsername, ctr.BrokerPassword = "broker", "secret"
+	})
+	rec := b.do(t, http.MethodGet, "/v2/catalog", nil)
+	expectCode(t, rec, http.StatusUnauthorized, "catalog without credentials")
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+	expectCode(t, b.do(t, http.MethodPut, instancePath(testInstanceId), provisionRequest(testPlanId)), http.StatusUnauthorized, "provision without credentials")
+	if n := len(b.aos.Requests()); n != 0 {
+		t.Errorf("unauthorized request reached AOS %d times", n)
+	}
+	expectCode(t, b.do(t, http.MethodGet, "/health", nil), http.StatusOK, "health")
+
+	b.header.Set("Authorization", "Basic "+basicAuth("broker", "wrong"))
+	expectCode(t, b.do(t, http.MethodGet, "/v2/catalog", nil), http.StatusUnauthorized, "catalog with wrong password")
+	b.header.Set("Authorization", "Basic "+basicAuth("broker", "secret"))
+	expectCode(t, b.do(t, http.MethodGet, "/v2/catalog", nil), http.StatusOK, "catalog with credentials")
+}
+
+func basicAuth(username, password string) string {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(username, password)
+	return req.Header.Get("Authorization")[len("Basic "):]
+}
+
+// 使用方应用节点上 BIND_SERVICES 中 redis 的条目
+func bindServices(t *testing.T, server *aostest.Server, appId string) []aos.EnvSetEntity {
+	t.Helper()
+	stack, ok := server.Stack(appId)
+	if !ok {
+		t.Fatal("consumer app " + appId + " not found")
+	}
+	var body aos.SetEnvbody
+	if err := json.Unmarshal(stack.Nodes[0].Properties, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.BindEnv.BindServices["redis"]
+}
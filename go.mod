@@ -2,4 +2,9 @@ module service-broker
 
 go 1.16
 
-require github.com/astaxie/beego v1.12.3
+require (
+	github.com/astaxie/beego v1.12.3
+	github.com/xeipuuv/gojsonschema v1.2.0
+	go.etcd.io/bbolt v1.3.6
+	sigs.k8s.io/yaml v1.3.0
+)
@@ -0,0 +1,119 @@
+package models
+
+// OSB v2.x 请求/响应模型, 以及平台扩展字段(userdata, base_info 等)
+
+// 平台扩展: 实例在后端的真实信息
+type BaseInfo struct {
+	ActualId     string `json:"actual_id"`
+	InstanceType string `json:"instance_type"`
+	ActualName   string `json:"actual_name"`
+}
+
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PUT /v2/service_instances/:instance_id
+type CreateInstReq struct {
+	ServiceId        string                 `json:"service_id"`
+	PlanId           string                 `json:"plan_id"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+	OrganizationGuid string                 `json:"organization_guid"`
+	SpaceGuid        string                 `json:"space_guid"`
+	Parameters       map[string]interface{} `json:"parameters,omitempty"`
+	MaintenanceInfo  *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+	// 平台扩展
+	InstanceName string `json:"instance_name,omitempty"`
+	BlueprintId  string `json:"blueprint_id,omitempty"`
+}
+
+// GET /v2/service_instances/:instance_id
+type GetInstResp struct {
+	ServiceId    string                 `json:"service_id"`
+	PlanId       string                 `json:"plan_id"`
+	DashboardUrl string                 `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type CreateInstResp struct {
+	DashboardUrl string   `json:"dashboard_url,omitempty"`
+	Operation    string   `json:"operation,omitempty"`
+	Userdata     string   `json:"userdata,omitempty"`
+	BaseInfo     BaseInfo `json:"base_info"`
+}
+
+// 平台在删除等请求中带回创建时返回的 userdata
+type Userdatas struct {
+	Userdata string `json:"userdata"`
+}
+
+type PreviousValues struct {
+	ServiceId       string           `json:"service_id,omitempty"`
+	PlanId          string           `json:"plan_id,omitempty"`
+	OrganizationId  string           `json:"organization_id,omitempty"`
+	SpaceId         string           `json:"space_id,omitempty"`
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// PATCH /v2/service_instances/:instance_id
+type UpdateInstReq struct {
+	ServiceId       string                 `json:"service_id"`
+	PlanId          string                 `json:"plan_id,omitempty"`
+	Context         map[string]interface{} `json:"context,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	PreviousValues  *PreviousValues        `json:"previous_values,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+	// 平台扩展
+	Userdata string `json:"userdata,omitempty"`
+}
+
+type BindResource struct {
+	AppGuid string `json:"app_guid,omitempty"`
+	Route   string `json:"route,omitempty"`
+}
+
+// PUT /v2/service_instances/:instance_id/service_bindings/:binding_id
+type CreateBindReq struct {
+	ServiceId    string                 `json:"service_id"`
+	PlanId       string                 `json:"plan_id"`
+	AppGuid      string                 `json:"app_guid,omitempty"`
+	BindResource *BindResource          `json:"bind_resource,omitempty"`
+	Context      map[string]interface{} `json:"context,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+	// 平台扩展
+	Userdata string `json:"userdata,omitempty"`
+}
+
+// 被绑定的应用, 优先使用 bind_resource.app_guid
+func (r *CreateBindReq) BoundAppGuid() string {
+	if r.BindResource != nil && r.BindResource.AppGuid != "" {
+		return r.BindResource.AppGuid
+	}
+	return r.AppGuid
+}
+
+type CreateBindResp struct {
+	Credentials     map[string]interface{} `json:"credentials,omitempty"`
+	SyslogDrainUrl  string                 `json:"syslog_drain_url,omitempty"`
+	RouteServiceUrl string                 `json:"route_service_url,omitempty"`
+	Operation       string                 `json:"operation,omitempty"`
+	Userdata        string                 `json:"userdata,omitempty"`
+}
+
+// GET /v2/service_instances/:instance_id/service_bindings/:binding_id
+type GetBindResp struct {
+	Credentials     map[string]interface{} `json:"credentials,omitempty"`
+	SyslogDrainUrl  string                 `json:"syslog_drain_url,omitempty"`
+	RouteServiceUrl string                 `json:"route_service_url,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// GET /v2/service_instances/:instance_id/last_operation
+// GET /v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation
+type LastOperationRsp struct {
+	State         string `json:"state"`
+	Description   string `json:"description,omitempty"`
+	Dashboard_url string `json:"dashboard_url,omitempty"`
+	Userdata      string `json:"userdata,omitempty"`
+}
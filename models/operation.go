@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// 早期平台通过 operation 查询参数传递的操作类型
+const (
+	LEGACY_OPERATION_CREATE = "create"
+	LEGACY_OPERATION_UPDATE = "update"
+	LEGACY_OPERATION_DELETE = "delete"
+)
+
+// 异步响应中返回的 operation, 平台原样带回 last_operation
+type OperationToken struct {
+	Kind      string `json:"kind"`
+	AppId     string `json:"app_id"`
+	Region    string `json:"region,omitempty"`
+	Backend   string `json:"backend,omitempty"` // 为空表示 AOS
+	StartedAt int64  `json:"started_at"`        // UnixNano
+}
+
+func NewOperationToken(kind, appId, region string, startedAt time.Time) OperationToken {
+	return OperationToken{Kind: kind, AppId: appId, Region: region, StartedAt: startedAt.UnixNano()}
+}
+
+// 编码为不透明的字符串: base64(JSON)
+func (t OperationToken) Encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeOperationToken(s string) (OperationToken, error) {
+	var t OperationToken
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return t, errors.New("invalid operation: " + err.Error())
+	}
+	if err = json.Unmarshal(data, &t); err != nil {
+		return t, errors.New("invalid operation: " + err.Error())
+	}
+	if t.Kind == "" || t.AppId == "" {
+		return t, errors.New("invalid operation: kind and app_id are required")
+	}
+	return t, nil
+}
+
+// operation 是否为早期的 create/update/delete
+func IsLegacyOperation(operation string) bool {
+	return operation == LEGACY_OPERATION_CREATE || operation == LEGACY_OPERATION_UPDATE || operation == LEGACY_OPERATION_DELETE
+}
+
+// 202 Accepted 响应体
+type OperationResp struct {
+	Operation string `json:"operation,omitempty"`
+}
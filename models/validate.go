@@ -0,0 +1,99 @@
+package models
+
+import (
+	"strings"
+)
+
+// OSB 规范的错误响应体
+type ErrorResponse struct {
+	Error            string       `json:"error,omitempty"`
+	Description      string       `json:"description,omitempty"`
+	InstanceUsable   *bool        `json:"instance_usable,omitempty"`
+	UpdateRepeatable *bool        `json:"update_repeatable,omitempty"`
+	Fields           []FieldError `json:"fields,omitempty"` // 扩展: 参数校验失败的字段
+}
+
+type FieldError struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// 请求校验失败, 对应 400 Bad Request
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Description)
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Add(field, description string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Description: description})
+}
+
+// 没有错误时返回 nil, 避免返回值为 nil 指针的非 nil error
+func (e *ValidationError) ErrOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// 生成 400 响应体
+func (e *ValidationError) Response() ErrorResponse {
+	return ErrorResponse{
+		Description: e.Error(),
+		Fields:      e.Fields,
+	}
+}
+
+func validateMaintenanceInfo(v *ValidationError, field string, info *MaintenanceInfo) {
+	if info != nil && info.Version == "" {
+		v.Add(field+".version", "must not be empty")
+	}
+}
+
+func (r *CreateInstReq) Validate() error {
+	v := &ValidationError{}
+	if r.ServiceId == "" {
+		v.Add("service_id", "must not be empty")
+	}
+	if r.PlanId == "" {
+		v.Add("plan_id", "must not be empty")
+	}
+	if r.OrganizationGuid == "" {
+		v.Add("organization_guid", "must not be empty")
+	}
+	if r.SpaceGuid == "" {
+		v.Add("space_guid", "must not be empty")
+	}
+	validateMaintenanceInfo(v, "maintenance_info", r.MaintenanceInfo)
+	return v.ErrOrNil()
+}
+
+func (r *UpdateInstReq) Validate() error {
+	v := &ValidationError{}
+	if r.ServiceId == "" {
+		v.Add("service_id", "must not be empty")
+	}
+	validateMaintenanceInfo(v, "maintenance_info", r.MaintenanceInfo)
+	if r.PreviousValues != nil {
+		validateMaintenanceInfo(v, "previous_values.maintenance_info", r.PreviousValues.MaintenanceInfo)
+	}
+	return v.ErrOrNil()
+}
+
+func (r *CreateBindReq) Validate() error {
+	v := &ValidationError{}
+	if r.ServiceId == "" {
+		v.Add("service_id", "must not be empty")
+	}
+	if r.PlanId == "" {
+		v.Add("plan_id", "must not be empty")
+	}
+	return v.ErrOrNil()
+}
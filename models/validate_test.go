@@ -0,0 +1,107 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 校验失败的字段名, 没有错误时为空
+func invalidFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	v, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("error = %T %v, want *ValidationError", err, err)
+	}
+	fields := make([]string, 0, len(v.Fields))
+	for _, f := range v.Fields {
+		if f.Description != "must not be empty" {
+			t.Errorf("%s: description = %q", f.Field, f.Description)
+		}
+		fields = append(fields, f.Field)
+	}
+	return fields
+}
+
+func TestCreateInstReqValidate(t *testing.T) {
+	valid := func() CreateInstReq {
+		return CreateInstReq{ServiceId: "service", PlanId: "plan", OrganizationGuid: "org", SpaceGuid: "space"}
+	}
+	cases := []struct {
+		name   string
+		modify func(r *CreateInstReq)
+		want   []string
+	}{
+		{"valid", func(r *CreateInstReq) {}, nil},
+		{"no service_id", func(r *CreateInstReq) { r.ServiceId = "" }, []string{"service_id"}},
+		{"no plan_id", func(r *CreateInstReq) { r.PlanId = "" }, []string{"plan_id"}},
+		{"no organization_guid", func(r *CreateInstReq) { r.OrganizationGuid = "" }, []string{"organization_guid"}},
+		{"no space_guid", func(r *CreateInstReq) { r.SpaceGuid = "" }, []string{"space_guid"}},
+		{"maintenance_info without version", func(r *CreateInstReq) { r.MaintenanceInfo = &MaintenanceInfo{} }, []string{"maintenance_info.version"}},
+		{"maintenance_info with version", func(r *CreateInstReq) { r.MaintenanceInfo = &MaintenanceInfo{Version: "1.0.0"} }, nil},
+		{"empty", func(r *CreateInstReq) { *r = CreateInstReq{} }, []string{"service_id", "plan_id", "organization_guid", "space_guid"}},
+	}
+	for _, c := range cases {
+		r := valid()
+		c.modify(&r)
+		if got := invalidFields(t, r.Validate()); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: invalid fields = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUpdateInstReqValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		req  UpdateInstReq
+		want []string
+	}{
+		{"valid", UpdateInstReq{ServiceId: "service"}, nil},
+		{"no service_id", UpdateInstReq{PlanId: "plan"}, []string{"service_id"}},
+		{"maintenance_info without version", UpdateInstReq{ServiceId: "service", MaintenanceInfo: &MaintenanceInfo{}}, []string{"maintenance_info.version"}},
+		{"previous maintenance_info without version",
+			UpdateInstReq{ServiceId: "service", PreviousValues: &PreviousValues{MaintenanceInfo: &MaintenanceInfo{}}},
+			[]string{"previous_values.maintenance_info.version"}},
+		{"previous_values without maintenance_info", UpdateInstReq{ServiceId: "service", PreviousValues: &PreviousValues{PlanId: "plan"}}, nil},
+	}
+	for _, c := range cases {
+		if got := invalidFields(t, c.req.Validate()); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: invalid fields = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCreateBindReqValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		req  CreateBindReq
+		want []string
+	}{
+		{"valid", CreateBindReq{ServiceId: "service", PlanId: "plan"}, nil},
+		{"no service_id", CreateBindReq{PlanId: "plan"}, []string{"service_id"}},
+		{"no plan_id", CreateBindReq{ServiceId: "service"}, []string{"plan_id"}},
+		{"empty", CreateBindReq{}, []string{"service_id", "plan_id"}},
+	}
+	for _, c := range cases {
+		if got := invalidFields(t, c.req.Validate()); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: invalid fields = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	v := &ValidationError{}
+	if err := v.ErrOrNil(); err != nil {
+		t.Errorf("ErrOrNil without fields = %v", err)
+	}
+	v.Add("service_id", "must not be empty")
+	v.Add("plan_id", "must not be empty")
+	if msg := v.Error(); msg != "invalid request: service_id: must not be empty; plan_id: must not be empty" {
+		t.Errorf("Error() = %q", msg)
+	}
+	if resp := v.Response(); resp.Description != v.Error() || len(resp.Fields) != 2 {
+		t.Errorf("Response() = %+v", resp)
+	}
+}
@@ -0,0 +1,357 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/astaxie/beego"
+	"service-broker/aos"
+	"service-broker/binding"
+	"service-broker/catalog"
+	"service-broker/common"
+	"service-broker/store"
+)
+
+const (
+	ROLLBACK_TIMEOUT       = 30 // 秒, 启动失败后等待删除APP的时间
+	ROLLBACK_POLL_INTERVAL = 2 * time.Second
+	STATUS_PENDING         = "Pending" // AOS 中已创建、尚未启动的 stack
+)
+
+// 同一实例的创建请求串行执行, 避免并发的重试都找不到 stack 而重复创建
+var provisionLocks = aos.NewKeyedMutex()
+
+// 通过 AOS 编排 stack 提供服务实例, 实例所在区域记录在 store.Instance.Region
+type AOS struct {
+	Regions         *aos.Registry
+	Store           *store.Store // 记录需要回收的 stack
+	RollbackTimeout time.Duration
+}
+
+// 从 app.conf 读取 rollback_timeout(秒)
+func NewAOS(regions *aos.Registry, instances *store.Store) *AOS {
+	return &AOS{
+		Regions:         regions,
+		Store:           instances,
+		RollbackTimeout: time.Duration(beego.AppConfig.DefaultInt("rollback_timeout", ROLLBACK_TIMEOUT)) * time.Second,
+	}
+}
+
+func (p *AOS) Type() string {
+	return BACKEND_AOS
+}
+
+// 创建并启动 APP; 启动失败时删除刚创建的APP
+func (p *AOS) Provision(req *ProvisionRequest) (string, error) {
+	region, err := p.Regions.Get(req.Region)
+	if err != nil {
+		return "", err
+	}
+	token := region.AuthToken(req.Token)
+	unlock := provisionLocks.Lock(req.InstanceId)
+	defer unlock()
+	//上次创建后未来得及保存时 AOS 中已有同名 stack, 直接接管
+	stack, err := p.findExisting(req, region, token)
+	if err != nil {
+		return "", err
+	}
+	if stack != nil {
+		beego.Info("Found existing app "+stack.Id+" for instance "+req.InstanceId+", status:", stack.Status)
+		if stack.TemplateId != "" && stack.TemplateId != req.Plan.BlueprintId {
+			beego.Warn("Existing app " + stack.Id + " uses template " + stack.TemplateId + ", expect " + req.Plan.BlueprintId)
+			return "", common.NewError(common.KindConflict, "Provision", "app "+req.Name+" already exists with template "+stack.TemplateId)
+		}
+		//上次创建后未来得及启动
+		if stack.Status == STATUS_PENDING {
+			return p.start(req, region, stack.Id, token)
+		}
+		return stack.Id, nil
+	}
+	//1. 创建APP, plan 的默认参数在用户参数之下合并
+	inputs := req.Plan.Inputs(aos.WithoutRegion(req.Parameters))
+	appId, err := region.Client.CreateApp(req.Name, req.Plan.BlueprintId, inputs, token, region.Project(req.SpaceGuid))
+	if err != nil {
+		beego.Warn("Call AOS CreateApp fail! err:", err)
+		return "", err
+	}
+	return p.start(req, region, appId, token)
+}
+
+// 按名称查找上次未记录的 stack. 找不到时再按升级前的名称查找, 旧名称可能与其它实例重复, 已记录在其它实例中的 stack 不接管;
+// 接管旧名称的 stack 时把 req.Name 改为其实际名称
+func (p *AOS) findExisting(req *ProvisionRequest, region *aos.Region, token string) (*aos.StackInfo, error) {
+	for i, name := range []string{req.Name, req.LegacyName} {
+		if name == "" || (i > 0 && name == req.Name) {
+			continue
+		}
+		stack, err := region.Client.FindAppByName(name, token, region.Project(req.SpaceGuid))
+		if err != nil {
+			beego.Warn("Find app by name "+name+" fail! err:", err)
+			return nil, err
+		}
+		if stack == nil {
+			continue
+		}
+		if i > 0 {
+			owned, err := p.ownedByOther(stack.Id, req.InstanceId)
+			if err != nil {
+				return nil, err
+			}
+			if owned {
+				beego.Info("App " + stack.Id + " named " + name + " belongs to another instance")
+				continue
+			}
+			req.Name = name
+		}
+		return stack, nil
+	}
+	return nil, nil
+}
+
+// app 是否已记录在其它实例中
+func (p *AOS) ownedByOther(appId, instanceId string) (bool, error) {
+	instances, err := p.Store.List()
+	if err != nil {
+		return false, err
+	}
+	for _, inst := range instances {
+		if inst.AppId == appId && inst.InstanceId != instanceId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 启动APP，异步的，所以直接返回。启动失败时删除该APP
+func (p *AOS) start(req *ProvisionRequest, region *aos.Region, appId, token string) (string, error) {
+	status, success, err := region.Client.StartApp(appId, token)
+	if err != nil || success != true {
+		beego.Warn("Call AOS StartApp fail! status:", status, " err:", err)
+		if err == nil {
+			err = common.NewError(common.KindInternal, "Start app", "status "+strconv.Itoa(status))
+		}
+		if p.rollback(req, region, appId, token) {
+			return "", err
+		}
+		return appId, err
+	}
+	return appId, nil
+}
+
+// 删除创建失败的APP并等待删除完成; 未能在 RollbackTimeout 内确认删除时记录该 stack, 等待回收
+func (p *AOS) rollback(req *ProvisionRequest, region *aos.Region, appId, token string) bool {
+	description := "start app fail"
+	_, success, err := region.Client.DeleteApp(appId, token)
+	if err == nil && success {
+		deadline := time.Now().Add(p.RollbackTimeout)
+		for {
+			if deleted, _ := region.Client.CheckAppDeleteSuccess(appId, token); deleted {
+				beego.Info("Rollback app " + appId + " of instance " + req.InstanceId + " success")
+				return true
+			}
+			if time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(ROLLBACK_POLL_INTERVAL)
+		}
+		description += ", app is still being deleted"
+	} else {
+		beego.Error("Rollback app "+appId+" of instance "+req.InstanceId+" fail! err:", err)
+		description += ", delete app fail"
+	}
+	err = p.Store.RecordStack(&store.StackRecord{
+		Region:      region.Name,
+		AppId:       appId,
+		StackName:   req.Name,
+		InstanceId:  req.InstanceId,
+		Operation:   store.OPERATION_CREATE,
+		Reason:      store.STACK_REASON_ROLLBACK,
+		Description: description,
+	})
+	if err != nil {
+		beego.Error("Record stack "+appId+" for garbage collection fail! err:", err)
+	}
+	return false
+}
+
+func (p *AOS) Deprovision(inst *store.Instance, token string) error {
+	region, err := p.Regions.Get(inst.Region)
+	if err != nil {
+		return err
+	}
+	status, success, err := region.Client.DeleteApp(inst.AppId, authToken(region, inst, token))
+	if err != nil {
+		beego.Warn("Call AOS DeleteApp fail! err:", err)
+		return err
+	}
+	if success != true {
+		beego.Warn("Call AOS DeleteApp fail! status:", status)
+		return common.NewError(common.KindInternal, "Delete app", "status "+strconv.Itoa(status))
+	}
+	return nil
+}
+
+func (p *AOS) Update(inst *store.Instance, parameters map[string]interface{}, token string) error {
+	if len(parameters) == 0 {
+		return nil
+	}
+	region, err := p.Regions.Get(inst.Region)
+	if err != nil {
+		return err
+	}
+	// 支持所有参数的更新 by wxy
+	success, err := region.Client.UpdateInstancesInputs(inst.AppId, authToken(region, inst, token), parameters)
+	if err != nil {
+		beego.Error("call Broker UpdateInstancesInputs error, error is: ", err)
+		return err
+	}
+	beego.Info("Broker UpdateInstances success: ", success)
+	return nil
+}
+
+func (p *AOS) LastOperation(inst *store.Instance, kind, token string) (*OperationStatus, error) {
+	region, err := p.Regions.Get(inst.Region)
+	if err != nil {
+		return &OperationStatus{State: store.STATE_FAILED, Description: err.Error()}, nil
+	}
+	token = authToken(region, inst, token)
+	appStatus, err := region.Client.QueryAppStatus(inst.AppId, token)
+	if err != nil {
+		return nil, err
+	}
+	if appStatus == "" {
+		return nil, common.NewError(common.KindInternal, "Query app status", "app "+inst.AppId+" status unknown")
+	}
+	res := &OperationStatus{State: store.STATE_IN_PROGRESS, Status: appStatus}
+	switch kind {
+	case store.OPERATION_CREATE, store.OPERATION_UPDATE:
+		switch appStatus {
+		case aos.RUNNING:
+			res.State = store.STATE_SUCCEEDED
+			res.DashboardUrl = getDashboard(region.Client, inst.AppId, token)
+		case aos.ABNORMAL, aos.APP_NOT_EXIST:
+			res.State = store.STATE_FAILED
+			res.Description = "app status is " + appStatus
+		}
+	case store.OPERATION_DELETE:
+		if appStatus == aos.APP_NOT_EXIST {
+			res.State = store.STATE_SUCCEEDED
+		}
+	}
+	return res, nil
+}
+
+// 按 plan 的绑定策略生成使用服务实例的账号, 并注入到使用方应用的 BIND_SERVICES 环境变量, 注入失败时回收账号.
+// 使用方应用由平台指定, 始终使用平台的 token 访问
+func (p *AOS) Bind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) (map[string]interface{}, error) {
+	region, err := p.Regions.Get(inst.Region)
+	if err != nil {
+		return nil, err
+	}
+	instToken := authToken(region, inst, token)
+	strategy := binding.ForPlan(plan)
+	credentials, err := strategy.Bind(region.Client, inst.AppId, instToken, b.BindingId, b.Parameters)
+	if err != nil {
+		beego.Warn("Create credentials of binding "+b.BindingId+" fail! err:", err)
+		return nil, err
+	}
+	if b.AppGuid == "" {
+		return credentials, nil
+	}
+	err = region.Client.ModifyBindServices(b.AppGuid, service.Name, bindEnvEntity(b.EnvName, service, plan, credentials), token, aos.MODE_ADD_OPERATE)
+	if err != nil {
+		beego.Warn("Inject BIND_SERVICES of app "+b.AppGuid+" fail! err:", err)
+		if err := strategy.Unbind(region.Client, inst.AppId, instToken, b.BindingId, credentials); err != nil {
+			beego.Error("Rollback credentials of binding "+b.BindingId+" fail! err:", err)
+		}
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// 从使用方应用的 BIND_SERVICES 环境变量中移除服务实例并回收账号
+func (p *AOS) Unbind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) error {
+	region, err := p.Regions.Get(inst.Region)
+	if err != nil {
+		return err
+	}
+	if b.AppGuid != "" {
+		serviceName := inst.ServiceId
+		if service != nil {
+			serviceName = service.Name
+		}
+		err := region.Client.ModifyBindServices(b.AppGuid, serviceName, aos.EnvSetEntity{Name: b.EnvName}, token, aos.MODE_DEL_OPERATE)
+		if err != nil && !common.IsGone(err) {
+			beego.Warn("Remove BIND_SERVICES of app "+b.AppGuid+" fail! err:", err)
+			return err
+		}
+	}
+	//plan 已从 catalog 中移除时无需回收
+	if plan != nil {
+		if err := binding.ForPlan(plan).Unbind(region.Client, inst.AppId, authToken(region, inst, token), b.BindingId, b.Credentials); err != nil {
+			beego.Warn("Revoke credentials of binding "+b.BindingId+" fail! err:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *AOS) Status(inst *store.Instance, token string) (string, error) {
+	region, err := p.Regions.Get(inst.Region)
+	if err != nil {
+		return "", err
+	}
+	status, err := region.Client.QueryAppStatus(inst.AppId, authToken(region, inst, token))
+	if err != nil {
+		return "", err
+	}
+	beego.Info("app status from aos is: ", status)
+	switch status {
+	case aos.RUNNING:
+		return STATUS_AVAILABLE, nil
+	case aos.APP_NOT_EXIST:
+		return STATUS_NOT_EXIST, nil
+	}
+	return STATUS_UNAVAILABLE, nil
+}
+
+// 区域配置的 token 只用于实例存储中的 app, 平台传入的 app id 使用平台的 token
+func authToken(region *aos.Region, inst *store.Instance, token string) string {
+	if inst.Transient {
+		return token
+	}
+	return region.AuthToken(token)
+}
+
+func getDashboard(client *aos.Client, appId, token string) string {
+	// 获取服务的URI后缀
+	uri := beego.AppConfig.String("service_uri")
+	//访问路径
+	dashboardUrl, err := client.GetDashboardUrl(appId, token)
+	if err != nil {
+		beego.Warn("app getDashboard failed, error is: ", err)
+	} else {
+		//这里是根据Blueprint中的output章节的内容获取的:针对Container的应用这里怎么取到nodePort待确认
+		//ips, _ := outputs["hostip"].([]interface{})
+		//ip, _ := ips[0].(string)
+		//res.Dashboard_url = "http://" + ip + ":31108/v1/vmall"
+		dashboardUrl = "http://" + dashboardUrl + uri
+	}
+	return dashboardUrl
+}
+
+// BIND_SERVICES 环境变量中的一项, 凭据以 JSON 字符串保存
+func bindEnvEntity(name string, service *catalog.Service, plan *catalog.Plan, credentials map[string]interface{}) aos.EnvSetEntity {
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		beego.Error("Marshal credentials fail! err:", err)
+	}
+	return aos.EnvSetEntity{
+		Name:        name,
+		Label:       service.Name,
+		Tags:        service.Tags,
+		Plan:        plan.Name,
+		Credentials: string(data),
+	}
+}
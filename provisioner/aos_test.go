@@ -0,0 +1,173 @@
+package provisioner_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"service-broker/aos"
+	"service-broker/aostest"
+	"service-broker/catalog"
+	"service-broker/common"
+	"service-broker/provisioner"
+	"service-broker/store"
+)
+
+const (
+	testRegion     = "r1"
+	testInstanceId = "5b1a7c1e-6a3f-4b0a-9a6e-3c2f5e1d0a01"
+	testBlueprint  = "blueprint-1"
+)
+
+type env struct {
+	aos     *aostest.Server
+	store   *store.Store
+	backend *provisioner.AOS
+	plan    *catalog.Plan
+}
+
+func newEnv(t *testing.T) *env {
+	dir, err := ioutil.TempDir("", "provisioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	instances, err := store.Open(filepath.Join(dir, "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instances.Close() })
+	server := aostest.NewServer()
+	t.Cleanup(server.Close)
+	regions, err := aos.NewRegistry(testRegion, server.Region(testRegion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &catalog.Plan{BlueprintId: testBlueprint}
+	plan.Id, plan.Name = "plan-1", "small"
+	return &env{
+		aos:     server,
+		store:   instances,
+		backend: &provisioner.AOS{Regions: regions, Store: instances, RollbackTimeout: time.Second},
+		plan:    plan,
+	}
+}
+
+func (e *env) request() *provisioner.ProvisionRequest {
+	return &provisioner.ProvisionRequest{
+		InstanceId: testInstanceId,
+		Name:       aos.GetStackName(aos.INSTANCE_STACK_PREFIX, "redis", testInstanceId),
+		LegacyName: aos.LegacyStackName(aos.INSTANCE_STACK_PREFIX, "redis", testInstanceId),
+		Region:     testRegion,
+		Plan:       e.plan,
+	}
+}
+
+// 升级前开始创建的 stack 按旧名称接管, 不重复创建
+func TestProvisionAdoptsLegacyStack(t *testing.T) {
+	e := newEnv(t)
+	req := e.request()
+	legacy := e.aos.AddStack(req.LegacyName, "", aostest.STATUS_RUNNING)
+
+	appId, err := e.backend.Provision(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appId != legacy.Id || req.Name != req.LegacyName {
+		t.Errorf("Provision = %s named %s, want %s named %s", appId, req.Name, legacy.Id, req.LegacyName)
+	}
+	if n := len(e.aos.Stacks()); n != 1 {
+		t.Errorf("stacks = %d, want 1", n)
+	}
+}
+
+// 旧名称可能与其它实例重复, 已属于其它实例的 stack 不接管
+func TestProvisionSkipsLegacyStackOfOtherInstance(t *testing.T) {
+	e := newEnv(t)
+	req := e.request()
+	legacy := e.aos.AddStack(req.LegacyName, "", aostest.STATUS_RUNNING)
+	if err := e.store.Put(&store.Instance{InstanceId: "5b1a7-other", AppId: legacy.Id, Region: testRegion}); err != nil {
+		t.Fatal(err)
+	}
+	name := req.Name
+
+	appId, err := e.backend.Provision(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appId == legacy.Id || req.Name != name {
+		t.Errorf("Provision adopted %s named %s", appId, req.Name)
+	}
+	if stack, ok := e.aos.Stack(appId); !ok || stack.Name != name || stack.TemplateId != testBlueprint {
+		t.Errorf("created stack = %+v", stack)
+	}
+}
+
+// 同名 stack 使用其它模板时不接管, 返回冲突
+func TestProvisionConflictsWithOtherTemplate(t *testing.T) {
+	e := newEnv(t)
+	req := e.request()
+	if _, err := e.aos.Client().CreateApp(req.Name, "blueprint-other", nil, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.backend.Provision(req); common.KindOf(err) != common.KindConflict {
+		t.Errorf("Provision error = %v, want conflict", err)
+	}
+	if n := len(e.aos.Stacks()); n != 1 {
+		t.Errorf("stacks = %d, want 1", n)
+	}
+}
+
+// 上次创建后未来得及启动的 stack 接管后启动
+func TestProvisionStartsPendingStack(t *testing.T) {
+	e := newEnv(t)
+	req := e.request()
+	appId, err := e.aos.Client().CreateApp(req.Name, testBlueprint, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := e.backend.Provision(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack, _ := e.aos.Stack(appId)
+	if got != appId || len(stack.Actions) != 1 || stack.Actions[0].Lifecycle != aostest.LIFECYCLE_CREATE {
+		t.Errorf("Provision = %s, actions = %+v", got, stack.Actions)
+	}
+}
+
+// 同一实例的并发请求只创建一个 stack
+func TestConcurrentProvision(t *testing.T) {
+	e := newEnv(t)
+	const n = 5
+	appIds := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			appId, err := e.backend.Provision(e.request())
+			if err != nil {
+				t.Error(err)
+			}
+			appIds <- appId
+		}()
+	}
+	wg.Wait()
+	close(appIds)
+
+	stacks := e.aos.Stacks()
+	if len(stacks) != 1 {
+		t.Fatalf("stacks = %d, want 1", len(stacks))
+	}
+	for appId := range appIds {
+		if appId != stacks[0].Id {
+			t.Errorf("Provision = %s, want %s", appId, stacks[0].Id)
+		}
+	}
+}
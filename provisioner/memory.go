@@ -0,0 +1,91 @@
+package provisioner
+
+import (
+	"sync"
+
+	"service-broker/catalog"
+	"service-broker/common"
+	"service-broker/store"
+)
+
+// 只在内存中记录实例的后端, 所有操作立即完成, 用于测试和演示
+type Memory struct {
+	mu        sync.Mutex
+	instances map[string]map[string]interface{} // 资源 id -> 参数
+}
+
+func NewMemory() *Memory {
+	return &Memory{instances: make(map[string]map[string]interface{})}
+}
+
+func (p *Memory) Type() string {
+	return BACKEND_MEMORY
+}
+
+func (p *Memory) Provision(req *ProvisionRequest) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := BACKEND_MEMORY + "-" + req.InstanceId
+	if _, ok := p.instances[id]; !ok {
+		p.instances[id] = req.Plan.Inputs(req.Parameters)
+	}
+	return id, nil
+}
+
+func (p *Memory) Deprovision(inst *store.Instance, token string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.instances[inst.AppId]; !ok {
+		return common.NewError(common.KindGone, "Deprovision", "instance "+inst.InstanceId+" not found")
+	}
+	delete(p.instances, inst.AppId)
+	return nil
+}
+
+func (p *Memory) Update(inst *store.Instance, parameters map[string]interface{}, token string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	inputs, ok := p.instances[inst.AppId]
+	if !ok {
+		return common.NewError(common.KindGone, "Update", "instance "+inst.InstanceId+" not found")
+	}
+	for k, v := range parameters {
+		inputs[k] = v
+	}
+	return nil
+}
+
+func (p *Memory) LastOperation(inst *store.Instance, kind, token string) (*OperationStatus, error) {
+	p.mu.Lock()
+	_, exists := p.instances[inst.AppId]
+	p.mu.Unlock()
+	if exists == (kind != store.OPERATION_DELETE) {
+		return &OperationStatus{State: store.STATE_SUCCEEDED}, nil
+	}
+	return &OperationStatus{State: store.STATE_FAILED, Description: "instance " + inst.InstanceId + " not found"}, nil
+}
+
+func (p *Memory) Bind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) (map[string]interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.instances[inst.AppId]; !ok {
+		return nil, common.NewError(common.KindGone, "Bind", "instance "+inst.InstanceId+" not found")
+	}
+	return map[string]interface{}{
+		"instance_id": inst.InstanceId,
+		"binding_id":  b.BindingId,
+	}, nil
+}
+
+func (p *Memory) Unbind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) error {
+	return nil
+}
+
+func (p *Memory) Status(inst *store.Instance, token string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.instances[inst.AppId]; !ok {
+		return STATUS_NOT_EXIST, nil
+	}
+	return STATUS_AVAILABLE, nil
+}
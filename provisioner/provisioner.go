@@ -0,0 +1,107 @@
+package provisioner
+
+import (
+	"errors"
+
+	"service-broker/catalog"
+	"service-broker/store"
+)
+
+const (
+	BACKEND_AOS    = "aos"
+	BACKEND_MEMORY = "memory"
+
+	// Status 的返回值
+	STATUS_AVAILABLE   = "available"
+	STATUS_UNAVAILABLE = "unavailable"
+	STATUS_NOT_EXIST   = "not_exist"
+)
+
+// 创建实例所需的信息
+type ProvisionRequest struct {
+	InstanceId string
+	Name       string // 后端资源名称, 例如 AOS stack 名称; 接管了 LegacyName 的资源时 Provision 将其改为 LegacyName
+	LegacyName string // 升级前命名规则下的资源名称, 为空时不查找
+	Region     string
+	SpaceGuid  string
+	Plan       *catalog.Plan
+	Parameters map[string]interface{}
+	Token      string // 平台请求中的 X-Auth-Token
+}
+
+// 一次异步操作在后端的进展
+type OperationStatus struct {
+	State        string // store.STATE_*
+	Description  string
+	Status       string // 后端的原始状态, 用于记录停留在中间状态的资源
+	DashboardUrl string
+}
+
+// 服务实例的后端, 由 plan 的 backend 字段选择. 参数中的 token 为平台请求中的 X-Auth-Token.
+type Provisioner interface {
+	// 后端类型, 即 base_info.instance_type
+	Type() string
+	// 创建实例并返回后端资源 id. 失败时返回的 id 非空表示资源仍然存在.
+	Provision(req *ProvisionRequest) (string, error)
+	Deprovision(inst *store.Instance, token string) error
+	Update(inst *store.Instance, parameters map[string]interface{}, token string) error
+	// 查询一次 kind(create/update/delete) 操作的进展, 查询失败时返回 error
+	LastOperation(inst *store.Instance, kind, token string) (*OperationStatus, error)
+	// 生成绑定凭据; plan 已从 catalog 中移除时 Unbind 的 plan 为 nil
+	Bind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) (map[string]interface{}, error)
+	Unbind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) error
+	// 实例当前状态, 取值为 STATUS_*
+	Status(inst *store.Instance, token string) (string, error)
+}
+
+type Registry struct {
+	backends    map[string]Provisioner
+	defaultType string
+}
+
+func NewRegistry(defaultType string, backends ...Provisioner) (*Registry, error) {
+	r := &Registry{backends: make(map[string]Provisioner), defaultType: defaultType}
+	for _, p := range backends {
+		if _, ok := r.backends[p.Type()]; ok {
+			return nil, errors.New("duplicate backend: " + p.Type())
+		}
+		r.backends[p.Type()] = p
+	}
+	if _, ok := r.backends[defaultType]; !ok {
+		return nil, errors.New("default backend not found: " + defaultType)
+	}
+	return r, nil
+}
+
+// typ 为空时返回默认后端
+func (r *Registry) Get(typ string) (Provisioner, error) {
+	if typ == "" {
+		typ = r.defaultType
+	}
+	p, ok := r.backends[typ]
+	if !ok {
+		return nil, errors.New("unknown backend: " + typ)
+	}
+	return p, nil
+}
+
+func (r *Registry) ForPlan(plan *catalog.Plan) (Provisioner, error) {
+	return r.Get(plan.Backend)
+}
+
+// 早期创建的实例没有记录 backend, 使用默认后端
+func (r *Registry) ForInstance(inst *store.Instance) (Provisioner, error) {
+	return r.Get(inst.Backend)
+}
+
+// 检查 catalog 中的 plan 是否都使用已注册的后端
+func (r *Registry) CheckCatalog(c *catalog.Catalog) error {
+	for _, s := range c.Services {
+		for i := range s.Plans {
+			if _, err := r.ForPlan(&s.Plans[i]); err != nil {
+				return errors.New("plan " + s.Plans[i].Name + " of service " + s.Name + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package reconciler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"service-broker/aos"
+	"service-broker/provisioner"
+	"service-broker/store"
+)
+
+const (
+	DEFAULT_INTERVAL     = 600  // 秒, 0 表示不定期执行
+	DEFAULT_ORPHAN_GRACE = 3600 // 秒, stack 持续无主超过该时间才会被删除
+)
+
+type Options struct {
+	Interval      time.Duration
+	DeleteOrphans bool          // 是否删除无主的 stack, 默认只报告
+	OrphanGrace   time.Duration // 避免删除刚创建、尚未写入实例存储的 stack
+}
+
+// 从 app.conf 读取 reconcile_interval, reconcile_delete_orphans, reconcile_orphan_grace(秒)
+func LoadOptions() Options {
+	return Options{
+		Interval:      time.Duration(beego.AppConfig.DefaultInt("reconcile_interval", DEFAULT_INTERVAL)) * time.Second,
+		DeleteOrphans: beego.AppConfig.DefaultBool("reconcile_delete_orphans", false),
+		OrphanGrace:   time.Duration(beego.AppConfig.DefaultInt("reconcile_orphan_grace", DEFAULT_ORPHAN_GRACE)) * time.Second,
+	}
+}
+
+// AOS 中存在、broker 中没有对应实例的 stack
+type Orphan struct {
+	AppId     string    `json:"app_id"`
+	StackName string    `json:"stack_name"`
+	Status    string    `json:"status,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// broker 中存在、AOS 中已没有 app 的实例
+type Lost struct {
+	InstanceId string `json:"instance_id"`
+	AppId      string `json:"app_id"`
+	StackName  string `json:"stack_name,omitempty"`
+}
+
+type RegionReport struct {
+	Region  string   `json:"region"`
+	Stacks  int      `json:"stacks"`
+	Orphans []Orphan `json:"orphans,omitempty"`
+	Lost    []Lost   `json:"lost,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type Report struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Regions    []RegionReport `json:"regions"`
+}
+
+// 定期比较各区域 AOS 中 broker 创建的 stack 与实例存储
+type Reconciler struct {
+	store   *store.Store
+	regions *aos.Registry
+	opts    Options
+
+	run       sync.Mutex // 同一时间只执行一次
+	mu        sync.Mutex
+	last      *Report
+	firstSeen map[string]time.Time // region/appId -> 第一次发现无主的时间
+}
+
+func New(instances *store.Store, regions *aos.Registry, opts Options) *Reconciler {
+	return &Reconciler{
+		store:     instances,
+		regions:   regions,
+		opts:      opts,
+		firstSeen: make(map[string]time.Time),
+	}
+}
+
+// 按 Interval 定期执行, Interval 为 0 时只能通过管理接口触发
+func (r *Reconciler) Start() {
+	if r.opts.Interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(r.opts.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			r.Reconcile()
+		}
+	}()
+}
+
+// 最近一次执行的结果, 尚未执行时返回 nil
+func (r *Reconciler) LastReport() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+func (r *Reconciler) Reconcile() *Report {
+	r.run.Lock()
+	defer r.run.Unlock()
+	report := &Report{StartedAt: time.Now()}
+	instances, err := r.store.List()
+	if err != nil {
+		beego.Error("Reconcile list instances fail! err:", err)
+		report.Regions = append(report.Regions, RegionReport{Error: err.Error()})
+	} else {
+		for _, region := range r.regions.List() {
+			report.Regions = append(report.Regions, r.reconcileRegion(region, instances))
+		}
+	}
+	report.FinishedAt = time.Now()
+	r.mu.Lock()
+	r.last = report
+	r.mu.Unlock()
+	return report
+}
+
+func (r *Reconciler) reconcileRegion(region *aos.Region, instances []*store.Instance) RegionReport {
+	report := RegionReport{Region: region.Name}
+	token := region.AuthToken("")
+	stacks, err := region.Client.ListApps("", token, region.Project(""))
+	if err != nil {
+		beego.Error("Reconcile list stacks of region "+region.Name+" fail! err:", err)
+		report.Error = err.Error()
+		return report
+	}
+	known := make(map[string]*store.Instance)
+	for _, inst := range instances {
+		//其它后端的实例不在 AOS 中
+		if inst.Backend != "" && inst.Backend != provisioner.BACKEND_AOS {
+			continue
+		}
+		if inst.Region == region.Name || (inst.Region == "" && region == r.regions.Default()) {
+			known[inst.AppId] = inst
+		}
+	}
+	now := time.Now()
+	listed := make(map[string]bool, len(stacks))
+	for _, stack := range stacks {
+		listed[stack.Id] = true
+		//只处理按 aos.GetStackName 格式命名的 stack, 其它 stack 不属于 broker
+		if !aos.IsStackName(aos.INSTANCE_STACK_PREFIX, stack.Name) {
+			continue
+		}
+		report.Stacks++
+		key := region.Name + "/" + stack.Id
+		if inst, ok := known[stack.Id]; ok {
+			r.forget(key)
+			if inst.Lost {
+				r.setLost(inst.InstanceId, false)
+			}
+			continue
+		}
+		orphan := Orphan{AppId: stack.Id, StackName: stack.Name, Status: stack.Status, FirstSeen: r.seen(key, now)}
+		if r.opts.DeleteOrphans && now.Sub(orphan.FirstSeen) >= r.opts.OrphanGrace {
+			if _, success, err := region.Client.DeleteApp(stack.Id, token); err != nil || !success {
+				beego.Error("Reconcile delete orphan stack "+stack.Name+" fail! err:", err)
+				if err != nil {
+					orphan.Error = err.Error()
+				}
+			} else {
+				beego.Info("Reconcile deleted orphan stack " + stack.Name + " (" + stack.Id + ")")
+				orphan.Deleted = true
+				r.forget(key)
+				if err := r.store.DeleteStack(region.Name, stack.Id); err != nil {
+					beego.Error("Remove stack record "+stack.Id+" fail! err:", err)
+				}
+			}
+		} else {
+			beego.Warn("Reconcile found orphan stack " + stack.Name + " (" + stack.Id + ") in region " + region.Name)
+		}
+		report.Orphans = append(report.Orphans, orphan)
+	}
+	//列表中没有的 app 再单独确认一次, 避免分页或 project 过滤造成误判
+	for appId, inst := range known {
+		if listed[appId] || !r.expectExists(inst) {
+			continue
+		}
+		status, err := region.Client.QueryAppStatus(appId, token)
+		if err != nil || status != aos.APP_NOT_EXIST {
+			continue
+		}
+		beego.Warn("Reconcile found lost instance " + inst.InstanceId + ", app " + appId + " not exist")
+		report.Lost = append(report.Lost, Lost{InstanceId: inst.InstanceId, AppId: appId, StackName: inst.StackName})
+		if !inst.Lost {
+			r.setLost(inst.InstanceId, true)
+		}
+	}
+	return report
+}
+
+// 实例当前是否应该有对应的 app: 正在删除或已删除的不算
+func (r *Reconciler) expectExists(inst *store.Instance) bool {
+	if inst.AppId == "" {
+		return false
+	}
+	op := inst.LastOperation()
+	return op == nil || op.Kind != store.OPERATION_DELETE
+}
+
+func (r *Reconciler) setLost(instanceId string, lost bool) {
+	err := r.store.Update(instanceId, func(inst *store.Instance) error {
+		inst.Lost = lost
+		return nil
+	})
+	if err != nil && err != store.ErrNotFound {
+		beego.Error("Mark instance "+instanceId+" lost fail! err:", err)
+	}
+}
+
+func (r *Reconciler) seen(key string, now time.Time) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.firstSeen[key]; ok {
+		return t
+	}
+	r.firstSeen[key] = now
+	return now
+}
+
+func (r *Reconciler) forget(key string) {
+	r.mu.Lock()
+	delete(r.firstSeen, key)
+	r.mu.Unlock()
+}
@@ -0,0 +1,180 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"service-broker/aos"
+	"service-broker/aostest"
+	"service-broker/store"
+)
+
+const testRegion = "r1"
+
+type env struct {
+	aos   *aostest.Server
+	store *store.Store
+}
+
+func newEnv(t *testing.T) *env {
+	dir, err := ioutil.TempDir("", "reconciler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	instances, err := store.Open(filepath.Join(dir, "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instances.Close() })
+	server := aostest.NewServer()
+	t.Cleanup(server.Close)
+	return &env{aos: server, store: instances}
+}
+
+func (e *env) reconciler(t *testing.T, opts Options) *Reconciler {
+	t.Helper()
+	regions, err := aos.NewRegistry(testRegion, e.aos.Region(testRegion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(e.store, regions, opts)
+}
+
+// 按 broker 的命名规则添加 stack
+func (e *env) addStack(instanceId string) *aostest.Stack {
+	return e.aos.AddStack(aos.GetStackName(aos.INSTANCE_STACK_PREFIX, "redis", instanceId), "", aostest.STATUS_RUNNING)
+}
+
+func (e *env) putInstance(t *testing.T, instanceId string, stack *aostest.Stack) {
+	t.Helper()
+	inst := &store.Instance{InstanceId: instanceId, StackName: stack.Name, AppId: stack.Id, Region: testRegion}
+	inst.StartOperation(store.OPERATION_CREATE)
+	inst.FinishOperation(store.STATE_SUCCEEDED, "")
+	if err := e.store.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 收到的删除 stackId 的请求数
+func (e *env) deletes(stackId string) int {
+	n := 0
+	for _, req := range e.aos.Requests() {
+		if req.Op == aostest.OP_DELETE && req.StackId == stackId {
+			n++
+		}
+	}
+	return n
+}
+
+func regionReport(t *testing.T, report *Report) RegionReport {
+	t.Helper()
+	if len(report.Regions) != 1 || report.Regions[0].Error != "" {
+		t.Fatalf("report = %+v", report)
+	}
+	return report.Regions[0]
+}
+
+// 有对应实例的 stack 和不按 broker 规则命名的 stack 都不是孤儿
+func TestKnownStacks(t *testing.T) {
+	e := newEnv(t)
+	stack := e.addStack("5b1a7c1e-0000-4b0a-9a6e-3c2f5e1d0a01")
+	e.putInstance(t, "5b1a7c1e-0000-4b0a-9a6e-3c2f5e1d0a01", stack)
+	e.aos.AddStack("manual", "", aostest.STATUS_RUNNING)
+
+	report := regionReport(t, e.reconciler(t, Options{DeleteOrphans: true}).Reconcile())
+	if report.Stacks != 1 || len(report.Orphans) != 0 || len(report.Lost) != 0 {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+// 无主时间未超过 OrphanGrace 的 stack 只报告, 不删除
+func TestOrphanWithinGrace(t *testing.T) {
+	e := newEnv(t)
+	stack := e.addStack("5b1a7c1e-0001-4b0a-9a6e-3c2f5e1d0a01")
+	r := e.reconciler(t, Options{DeleteOrphans: true, OrphanGrace: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		report := regionReport(t, r.Reconcile())
+		if len(report.Orphans) != 1 || report.Orphans[0].AppId != stack.Id || report.Orphans[0].Deleted {
+			t.Errorf("reconcile %d: orphans = %+v", i, report.Orphans)
+		}
+	}
+	if n := e.deletes(stack.Id); n != 0 {
+		t.Errorf("orphan deleted %d times within grace period", n)
+	}
+}
+
+// 无主超过 OrphanGrace 的 stack 只在开启 DeleteOrphans 时删除
+func TestOrphanPastGrace(t *testing.T) {
+	e := newEnv(t)
+	stack := e.addStack("5b1a7c1e-0002-4b0a-9a6e-3c2f5e1d0a01")
+	firstSeen := time.Now().Add(-2 * time.Hour)
+
+	r := e.reconciler(t, Options{OrphanGrace: time.Hour})
+	r.firstSeen[testRegion+"/"+stack.Id] = firstSeen
+	report := regionReport(t, r.Reconcile())
+	if len(report.Orphans) != 1 || report.Orphans[0].Deleted || !report.Orphans[0].FirstSeen.Equal(firstSeen) {
+		t.Errorf("orphans without delete_orphans = %+v", report.Orphans)
+	}
+	if n := e.deletes(stack.Id); n != 0 {
+		t.Fatalf("orphan deleted %d times without delete_orphans", n)
+	}
+
+	r = e.reconciler(t, Options{DeleteOrphans: true, OrphanGrace: time.Hour})
+	r.firstSeen[testRegion+"/"+stack.Id] = firstSeen
+	report = regionReport(t, r.Reconcile())
+	if len(report.Orphans) != 1 || !report.Orphans[0].Deleted {
+		t.Errorf("orphans with delete_orphans = %+v", report.Orphans)
+	}
+	if n := e.deletes(stack.Id); n != 1 {
+		t.Errorf("orphan deleted %d times with delete_orphans, want 1", n)
+	}
+	if _, ok := r.firstSeen[testRegion+"/"+stack.Id]; ok {
+		t.Error("deleted orphan still remembered")
+	}
+}
+
+// AOS 中已没有 app 的实例标记为 Lost, app 重新出现后清除
+func TestLostInstance(t *testing.T) {
+	e := newEnv(t)
+	instanceId := "5b1a7c1e-0003-4b0a-9a6e-3c2f5e1d0a01"
+	stack := e.addStack(instanceId)
+	e.putInstance(t, instanceId, stack)
+	e.aos.RemoveStack(stack.Id)
+	r := e.reconciler(t, Options{})
+
+	report := regionReport(t, r.Reconcile())
+	if len(report.Lost) != 1 || report.Lost[0].InstanceId != instanceId || report.Lost[0].AppId != stack.Id {
+		t.Errorf("lost = %+v", report.Lost)
+	}
+	if inst, err := e.store.Get(instanceId); err != nil || !inst.Lost {
+		t.Errorf("instance = %+v, %v, want lost", inst, err)
+	}
+}
+
+// 正在删除的实例没有 app 是正常的, 不标记为 Lost
+func TestDeletingInstanceNotLost(t *testing.T) {
+	e := newEnv(t)
+	instanceId := "5b1a7c1e-0004-4b0a-9a6e-3c2f5e1d0a01"
+	stack := e.addStack(instanceId)
+	e.putInstance(t, instanceId, stack)
+	err := e.store.Update(instanceId, func(inst *store.Instance) error {
+		inst.StartOperation(store.OPERATION_DELETE)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.aos.RemoveStack(stack.Id)
+
+	if report := regionReport(t, e.reconciler(t, Options{}).Reconcile()); len(report.Lost) != 0 {
+		t.Errorf("lost = %+v", report.Lost)
+	}
+	if inst, err := e.store.Get(instanceId); err != nil || inst.Lost {
+		t.Errorf("instance = %+v, %v", inst, err)
+	}
+}
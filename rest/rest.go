@@ -1,19 +1,207 @@
 package rest
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT = 10 // 单位: 秒
+	DEFAULT_REQUEST_TIMEOUT = 60 // 单位: 秒
+	DEFAULT_SCHEME          = "https://"
 )
 
-func DoHTTPrequest(url, endpoint, path string, headers, params map[string]string, body []byte) (http.Response, error) {
+// 客户端参数
+type Options struct {
+	ConnectTimeout time.Duration // 建立连接(含TLS握手)的超时时间
+	RequestTimeout time.Duration // 单个请求从发出到读完响应的超时时间
+	TLS            TLSOptions
+}
+
+// 访问后端 REST 服务的客户端
+type Client struct {
+	HTTPClient *http.Client
+
+	reloader *certReloader
+}
+
+// 包级默认客户端, DoHTTPrequest 等函数使用它
+var defaultClient *Client
+
+func init() {
+	var err error
+	defaultClient, err = NewClientFromConfig("http_")
+	if err != nil {
+		beego.Error("Init default http client error, fall back to default options, error is: ", err)
+		defaultClient, _ = NewClient(Options{})
+	}
+}
+
+// 从 app.conf 读取客户端参数, prefix 为配置项前缀, 例如 "http_" 对应 http_connect_timeout, http_request_timeout
+// 以及 LoadTLSOptions 中说明的 http_tls_* 配置项
+func LoadOptions(prefix string) (Options, error) {
+	tlsOpts, err := LoadTLSOptions(prefix)
+	if err != nil {
+		return Options{}, err
+	}
+	return Options{
+		ConnectTimeout: time.Duration(beego.AppConfig.DefaultInt(prefix+"connect_timeout", DEFAULT_CONNECT_TIMEOUT)) * time.Second,
+		RequestTimeout: time.Duration(beego.AppConfig.DefaultInt(prefix+"request_timeout", DEFAULT_REQUEST_TIMEOUT)) * time.Second,
+		TLS:            tlsOpts,
+	}, nil
+}
+
+func NewClientFromConfig(prefix string) (*Client, error) {
+	opts, err := LoadOptions(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(opts)
+}
+
+// 配置了证书文件时, 会启动后台协程按 TLS.ReloadInterval 检查文件变化并重新加载, 不再使用时调用 Close 停止
+func NewClient(opts Options) (*Client, error) {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DEFAULT_CONNECT_TIMEOUT * time.Second
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DEFAULT_REQUEST_TIMEOUT * time.Second
+	}
+	if opts.TLS.MinVersion == 0 {
+		opts.TLS.MinVersion = tls.VersionTLS12
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.RequestTimeout,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	reloader, err := newCertReloader(opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = reloader.config()
+	client := &Client{
+		HTTPClient: &http.Client{
+			Transport: transport,
+			Timeout:   opts.RequestTimeout,
+		},
+	}
+	if opts.TLS.CAFile != "" || opts.TLS.CertFile != "" {
+		// 证书更新后关闭空闲连接, 让后续请求使用新证书重新握手
+		reloader.onChange = transport.CloseIdleConnections
+		client.reloader = reloader
+		go reloader.watch()
+	}
+	return client, nil
+}
+
+// 停止检查证书文件并关闭空闲连接, 可以重复调用
+func (c *Client) Close() {
+	if c.reloader != nil {
+		c.reloader.close()
+	}
+	c.HTTPClient.CloseIdleConnections()
+}
+
+func DefaultClient() *Client {
+	return defaultClient
+}
+
+// 替换包级默认客户端, 例如测试时指向 httptest.Server 使用的客户端
+func SetDefaultClient(client *Client) {
+	defaultClient = client
+}
 
-	return http.Response{}, nil
+// 拼接请求地址: endpoint + path + 查询参数, endpoint 未带协议时默认使用 https
+func BuildUrl(endpoint, path string, params map[string]string) (string, error) {
+	if endpoint == "" {
+		return "", errors.New("endpoint is empty")
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = DEFAULT_SCHEME + endpoint
+	}
+	u, err := url.Parse(strings.TrimRight(endpoint, "/") + "/" + strings.TrimLeft(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	if len(params) > 0 {
+		query := u.Query()
+		for k, v := range params {
+			query.Set(k, v)
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), nil
 }
+
+// 发送请求, method 为 GET/POST/PUT/DELETE 等; 调用方负责通过 CopyResponseBody 或 CloseResponseBody 关闭响应体
+func (c *Client) Do(method, endpoint, path string, headers, params map[string]string, body []byte) (http.Response, error) {
+	reqUrl, err := BuildUrl(endpoint, path, params)
+	if err != nil {
+		return http.Response{}, err
+	}
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, reqUrl, reader)
+	if err != nil {
+		return http.Response{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return http.Response{}, err
+	}
+	return *resp, nil
+}
+
+func DoHTTPrequest(method, endpoint, path string, headers, params map[string]string, body []byte) (http.Response, error) {
+	return defaultClient.Do(method, endpoint, path, headers, params, body)
+}
+
+// 读取并关闭响应体
 func CopyResponseBody(response http.Response) ([]byte, error) {
-	return []byte{}, nil
+	if response.Body == nil {
+		return []byte{}, nil
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
 }
+
+// 2xx 认为成功
 func IsResponseStatusOk(response http.Response) bool {
-	return true
+	return response.StatusCode/100 == 2
 }
-func CloseResponseBody(response http.Response) {
 
+// 丢弃剩余内容后关闭响应体, 以便连接可以复用
+func CloseResponseBody(response http.Response) {
+	if response.Body == nil {
+		return
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
 }
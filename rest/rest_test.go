@@ -0,0 +1,135 @@
+package rest
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBuildUrl(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		path     string
+		params   map[string]string
+		want     string
+	}{
+		{"aos.example.com", "/v2/stacks", nil, "https://aos.example.com/v2/stacks"},
+		{"http://aos.example.com:8080/", "/v2/stacks", nil, "http://aos.example.com:8080/v2/stacks"},
+		{"https://aos.example.com/api", "v2/stacks/1", nil, "https://aos.example.com/api/v2/stacks/1"},
+		{"https://aos.example.com", "/v2/stacks", map[string]string{"name": "a b", "project_id": "p"}, "https://aos.example.com/v2/stacks?name=a+b&project_id=p"},
+	}
+	for _, c := range cases {
+		got, err := BuildUrl(c.endpoint, c.path, c.params)
+		if err != nil || got != c.want {
+			t.Errorf("BuildUrl(%q, %q, %v) = %q, %v, want %q", c.endpoint, c.path, c.params, got, err, c.want)
+		}
+	}
+	if _, err := BuildUrl("", "/v2/stacks", nil); err == nil {
+		t.Error("BuildUrl with empty endpoint succeeded")
+	}
+}
+
+func TestDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.URL.Path != "/v2/stacks/1" || r.URL.Query().Get("force") != "true" {
+			t.Errorf("request = %s %s", r.Method, r.URL)
+		}
+		if r.Header.Get("Accept") != "application/json" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Accept = %q, Content-Type = %q", r.Header.Get("Accept"), r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("X-Auth-Token") != "token" {
+			t.Errorf("X-Auth-Token = %q", r.Header.Get("X-Auth-Token"))
+		}
+		if string(body) != `{"a":1}` {
+			t.Errorf("body = %q", body)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+	client, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do("PUT", server.URL, "/v2/stacks/1", map[string]string{"X-Auth-Token": "token"}, map[string]string{"force": "true"}, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsResponseStatusOk(resp) {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+	body, err := CopyResponseBody(resp)
+	if err != nil || string(body) != `{"id":"1"}` {
+		t.Errorf("body = %q, %v", body, err)
+	}
+}
+
+func TestDoWithoutBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "" || r.ContentLength != 0 {
+			t.Errorf("Content-Type = %q, ContentLength = %d", r.Header.Get("Content-Type"), r.ContentLength)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}))
+	defer server.Close()
+	client, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do("GET", server.URL, "/v2/stacks/1", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsResponseStatusOk(resp) || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+	CloseResponseBody(resp)
+	if _, err = CopyResponseBody(http.Response{}); err != nil {
+		t.Errorf("CopyResponseBody without body: %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	client, err := NewClient(Options{RequestTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err = client.Do("GET", server.URL, "/", nil, nil, nil); err == nil {
+		t.Fatal("request succeeded after timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request returned after %v", elapsed)
+	}
+}
+
+func TestNewClientDefaults(t *testing.T) {
+	client, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.HTTPClient.Timeout != DEFAULT_REQUEST_TIMEOUT*time.Second {
+		t.Errorf("timeout = %v", client.HTTPClient.Timeout)
+	}
+	transport := client.HTTPClient.Transport.(*http.Transport)
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("min tls version = %x", transport.TLSClientConfig.MinVersion)
+	}
+	if _, err = NewClient(Options{TLS: TLSOptions{CertFile: "cert.pem"}}); err == nil {
+		t.Error("NewClient with cert file but no key file succeeded")
+	}
+}
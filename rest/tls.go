@@ -0,0 +1,219 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+const (
+	DEFAULT_TLS_RELOAD_INTERVAL = 60 // 单位: 秒
+	DEFAULT_TLS_MIN_VERSION     = "1.2"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS 参数, 证书文件变化后会自动重新加载, 无需重启
+type TLSOptions struct {
+	CAFile             string        // 校验服务端证书的 CA 证书包(PEM), 为空时使用系统 CA
+	CertFile           string        // 双向认证的客户端证书(PEM)
+	KeyFile            string        // 双向认证的客户端私钥(PEM)
+	ServerName         string        // 校验服务端证书时使用的主机名, 为空时使用请求地址中的主机
+	MinVersion         uint16        // 最低 TLS 版本
+	InsecureSkipVerify bool          // 不校验服务端证书, 仅用于调试
+	ReloadInterval     time.Duration // 检查证书文件变化的周期, <=0 时不检查
+}
+
+// 从 app.conf 读取 TLS 参数, 例如 prefix 为 "aos_" 时读取 aos_tls_ca_file, aos_tls_cert_file, aos_tls_key_file,
+// aos_tls_server_name, aos_tls_min_version(1.0/1.1/1.2/1.3), aos_tls_insecure_skip_verify, aos_tls_reload_interval(秒)
+func LoadTLSOptions(prefix string) (TLSOptions, error) {
+	opts := TLSOptions{
+		CAFile:             beego.AppConfig.String(prefix + "tls_ca_file"),
+		CertFile:           beego.AppConfig.String(prefix + "tls_cert_file"),
+		KeyFile:            beego.AppConfig.String(prefix + "tls_key_file"),
+		ServerName:         beego.AppConfig.String(prefix + "tls_server_name"),
+		InsecureSkipVerify: beego.AppConfig.DefaultBool(prefix+"tls_insecure_skip_verify", false),
+		ReloadInterval:     time.Duration(beego.AppConfig.DefaultInt(prefix+"tls_reload_interval", DEFAULT_TLS_RELOAD_INTERVAL)) * time.Second,
+	}
+	version := beego.AppConfig.DefaultString(prefix+"tls_min_version", DEFAULT_TLS_MIN_VERSION)
+	minVersion, ok := tlsVersions[version]
+	if !ok {
+		return opts, errors.New("unsupported tls min version: " + version)
+	}
+	opts.MinVersion = minVersion
+	return opts, nil
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	if path == "" {
+		return fileStamp{}, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// 负责加载并在文件变化时重新加载 CA 和客户端证书
+type certReloader struct {
+	opts     TLSOptions
+	onChange func()
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+	stamps [3]fileStamp // ca, cert, key
+}
+
+func newCertReloader(opts TLSOptions) (*certReloader, error) {
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("tls cert file and key file must be set together")
+	}
+	r := &certReloader{opts: opts, stop: make(chan struct{})}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 文件有变化时重新加载, 返回是否发生了变化; 加载失败时保留原有证书
+func (r *certReloader) reload() (bool, error) {
+	var stamps [3]fileStamp
+	for i, path := range []string{r.opts.CAFile, r.opts.CertFile, r.opts.KeyFile} {
+		stamp, err := statFile(path)
+		if err != nil {
+			return false, err
+		}
+		stamps[i] = stamp
+	}
+	r.mu.RLock()
+	unchanged := stamps == r.stamps && (r.pool != nil || r.cert != nil)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	var pool *x509.CertPool
+	if r.opts.CAFile != "" {
+		caPem, err := ioutil.ReadFile(r.opts.CAFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return false, errors.New("no certificate found in tls ca file: " + r.opts.CAFile)
+		}
+	}
+	var cert *tls.Certificate
+	if r.opts.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &pair
+	}
+	r.mu.Lock()
+	r.pool = pool
+	r.cert = cert
+	r.stamps = stamps
+	r.mu.Unlock()
+	return true, nil
+}
+
+// 按 ReloadInterval 检查文件变化, 直到 close
+func (r *certReloader) watch() {
+	if r.opts.ReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.opts.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.reload()
+		if err != nil {
+			beego.Error("Reload tls certificates error, keep the old ones, error is: ", err)
+			continue
+		}
+		if changed {
+			beego.Info("Tls certificates reloaded")
+			if r.onChange != nil {
+				r.onChange()
+			}
+		}
+	}
+}
+
+// 停止 watch, 可以重复调用
+func (r *certReloader) close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		// 未配置客户端证书时返回空证书, 由服务端决定是否拒绝
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+// 生成 tls.Config, 握手时使用最新加载的 CA 和客户端证书. 经过代理的 https 请求同样使用该配置握手
+func (r *certReloader) config() *tls.Config {
+	cfg := &tls.Config{
+		ServerName:           r.opts.ServerName,
+		MinVersion:           r.opts.MinVersion,
+		InsecureSkipVerify:   r.opts.InsecureSkipVerify,
+		GetClientCertificate: r.getClientCertificate,
+	}
+	if r.opts.CAFile != "" && !r.opts.InsecureSkipVerify {
+		// RootCAs 在握手时不能替换, 因此关闭内置校验, 由 VerifyConnection 使用当前的 CA 校验服务端证书
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = r.verifyConnection
+	}
+	return cfg
+}
+
+// 与内置校验相同: 用当前的 CA 校验证书链, 并校验证书与 ServerName 匹配
+func (r *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server did not provide a certificate")
+	}
+	r.mu.RLock()
+	pool := r.pool
+	r.mu.RUnlock()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
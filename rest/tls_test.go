@@ -0,0 +1,358 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的证书及其 PEM
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+var serial int64
+
+// 生成证书, parent 为空时生成自签名的 CA
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// 两套 CA 及其签发的服务端和客户端证书
+type testPKI struct {
+	ca, otherCa         *testCert
+	server              *testCert
+	client, otherClient *testCert
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	ca := newTestCert(t, "ca", nil, 0)
+	otherCa := newTestCert(t, "other-ca", nil, 0)
+	return &testPKI{
+		ca:          ca,
+		otherCa:     otherCa,
+		server:      newTestCert(t, "server", ca, x509.ExtKeyUsageServerAuth),
+		client:      newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth),
+		otherClient: newTestCert(t, "other-client", otherCa, x509.ExtKeyUsageClientAuth),
+	}
+}
+
+// 要求客户端证书由 ca 签发的 https 服务
+func newMutualTLSServer(t *testing.T, pki *testPKI) *httptest.Server {
+	t.Helper()
+	pair, err := tls.X509KeyPair(pki.server.certPem, pki.server.keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(pki.ca.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// 把 ca 证书和客户端证书写入临时目录, 返回对应的 TLSOptions
+func writeTLSFiles(t *testing.T, dir string, ca, client *testCert) TLSOptions {
+	t.Helper()
+	opts := TLSOptions{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	// 修改时间推后, 保证与上一次写入的文件不同
+	mtime := time.Now().Add(time.Duration(serial) * time.Second)
+	for path, data := range map[string][]byte{opts.CAFile: ca.certPem, opts.CertFile: client.certPem, opts.KeyFile: client.keyPem} {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		serial++
+	}
+	return opts
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rest-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func get(client *Client, url string) (string, error) {
+	resp, err := client.Do("GET", url, "/", nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := CopyResponseBody(resp)
+	return string(body), err
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	server := newMutualTLSServer(t, pki)
+	client, err := NewClient(Options{TLS: writeTLSFiles(t, tempDir(t), pki.ca, pki.client)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	body, err := get(client, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "client" {
+		t.Errorf("server saw client certificate %q", body)
+	}
+}
+
+func TestUntrustedServer(t *testing.T) {
+	pki := newTestPKI(t)
+	server := newMutualTLSServer(t, pki)
+	client, err := NewClient(Options{TLS: writeTLSFiles(t, tempDir(t), pki.otherCa, pki.client)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if _, err = get(client, server.URL); err == nil {
+		t.Error("request to server signed by an untrusted CA succeeded")
+	}
+}
+
+func TestUntrustedClient(t *testing.T) {
+	pki := newTestPKI(t)
+	server := newMutualTLSServer(t, pki)
+	client, err := NewClient(Options{TLS: writeTLSFiles(t, tempDir(t), pki.ca, pki.otherClient)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if _, err = get(client, server.URL); err == nil {
+		t.Error("request with client certificate signed by an untrusted CA succeeded")
+	}
+}
+
+// 证书文件更新后, 不重启客户端即可使用新的 CA 和客户端证书
+func TestReloadCertificates(t *testing.T) {
+	pki := newTestPKI(t)
+	server := newMutualTLSServer(t, pki)
+	dir := tempDir(t)
+	opts := writeTLSFiles(t, dir, pki.otherCa, pki.otherClient)
+	opts.ReloadInterval = 20 * time.Millisecond
+	client, err := NewClient(Options{TLS: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if _, err = get(client, server.URL); err == nil {
+		t.Fatal("request with untrusted certificates succeeded")
+	}
+
+	writeTLSFiles(t, dir, pki.ca, pki.client)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body, err := get(client, server.URL)
+		if err == nil {
+			if body != "client" {
+				t.Errorf("server saw client certificate %q", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificates not reloaded: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 只处理 CONNECT 的 https 代理, 记录经过代理的请求数
+func newConnectProxy(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+	var tunnels int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		backend, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(&tunnels, 1)
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			backend.Close()
+			return
+		}
+		go func() {
+			io.Copy(backend, conn)
+			backend.Close()
+		}()
+		io.Copy(conn, backend)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, &tunnels
+}
+
+// 配置了证书文件时仍然使用环境变量中的代理, 经过代理的请求同样使用重新加载的证书
+func TestReloadCertificatesThroughProxy(t *testing.T) {
+	pki := newTestPKI(t)
+	server := newMutualTLSServer(t, pki)
+	proxy, tunnels := newConnectProxy(t)
+	dir := tempDir(t)
+	opts := writeTLSFiles(t, dir, pki.otherCa, pki.otherClient)
+	opts.ReloadInterval = 20 * time.Millisecond
+	client, err := NewClient(Options{TLS: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	transport := client.HTTPClient.Transport.(*http.Transport)
+	if transport.Proxy == nil || transport.DialTLSContext != nil {
+		t.Fatal("transport ignores proxy settings or dials tls itself")
+	}
+	proxyUrl, _ := url.Parse(proxy.URL)
+	transport.Proxy = http.ProxyURL(proxyUrl)
+	if _, err = get(client, server.URL); err == nil {
+		t.Fatal("request with untrusted certificates succeeded")
+	}
+
+	writeTLSFiles(t, dir, pki.ca, pki.client)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body, err := get(client, server.URL)
+		if err == nil {
+			if body != "client" {
+				t.Errorf("server saw client certificate %q", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificates not reloaded: ", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if atomic.LoadInt32(tunnels) == 0 {
+		t.Error("requests did not go through the proxy")
+	}
+}
+
+// 服务端证书与 ServerName 不匹配时拒绝
+func TestServerNameMismatch(t *testing.T) {
+	pki := newTestPKI(t)
+	server := newMutualTLSServer(t, pki)
+	opts := writeTLSFiles(t, tempDir(t), pki.ca, pki.client)
+	opts.ServerName = "aos.example.com"
+	client, err := NewClient(Options{TLS: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if _, err = get(client, server.URL); err == nil {
+		t.Error("request to server with mismatched name succeeded")
+	}
+}
+
+// Close 之后不再检查证书文件
+func TestCloseStopsReloading(t *testing.T) {
+	pki := newTestPKI(t)
+	dir := tempDir(t)
+	opts := writeTLSFiles(t, dir, pki.otherCa, pki.otherClient)
+	opts.ReloadInterval = 10 * time.Millisecond
+	client, err := NewClient(Options{TLS: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	client.Close()
+	client.reloader.mu.RLock()
+	stamps := client.reloader.stamps
+	client.reloader.mu.RUnlock()
+
+	writeTLSFiles(t, dir, pki.ca, pki.client)
+	time.Sleep(100 * time.Millisecond)
+	client.reloader.mu.RLock()
+	defer client.reloader.mu.RUnlock()
+	if client.reloader.stamps != stamps {
+		t.Error("certificates reloaded after Close")
+	}
+	//未配置证书文件的客户端也可以 Close
+	plain, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+}
@@ -1,21 +1,78 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/astaxie/beego"
+	"service-broker/aos"
+	"service-broker/catalog"
+	"service-broker/provisioner"
+	"service-broker/reconciler"
+	"service-broker/store"
+	"service-broker/tracker"
 )
 
 func InitRoutes() {
-	var ctr = Controller{}
+	regions, err := aos.NewRegistryFromConfig()
+	if err != nil {
+		panic("init aos regions fail: " + err.Error())
+	}
+	catalogFile := beego.AppConfig.DefaultString("catalog_file", "conf/catalog.yaml")
+	services, err := catalog.Load(catalogFile)
+	if err != nil {
+		panic("load catalog " + catalogFile + " fail: " + err.Error())
+	}
+	storePath := beego.AppConfig.DefaultString("store_path", "data/broker.db")
+	instances, err := store.Open(storePath)
+	if err != nil {
+		panic("open instance store " + storePath + " fail: " + err.Error())
+	}
+	//plan 未指定 backend 时使用 AOS
+	provisioners, err := provisioner.NewRegistry(provisioner.BACKEND_AOS, provisioner.NewAOS(regions, instances), provisioner.NewMemory())
+	if err != nil {
+		panic("init provisioners fail: " + err.Error())
+	}
+	if err = provisioners.CheckCatalog(services); err != nil {
+		panic("check catalog " + catalogFile + " fail: " + err.Error())
+	}
+	operations := tracker.New(instances, provisioners, services, tracker.LoadOptions())
+	if err = operations.Start(); err != nil {
+		panic("start operation tracker fail: " + err.Error())
+	}
+	reconcile := reconciler.New(instances, regions, reconciler.LoadOptions())
+	reconcile.Start()
+	//区域 token 替代平台 token 时, 只有通过 basic auth 的请求才能使用它
+	brokerUsername, brokerPassword := beego.AppConfig.String("broker_username"), beego.AppConfig.String("broker_password")
+	if brokerUsername != "" && brokerPassword == "" {
+		panic("broker_password is required when broker_username is set")
+	}
+	if names := regions.TokenRegions(); len(names) > 0 && brokerUsername == "" {
+		panic("regions " + strings.Join(names, ",") + " set aos_use_token, broker_username and broker_password are required")
+	}
+	var ctr = Controller{Regions: regions, Catalog: services, Store: instances, Tracker: operations, Provisioners: provisioners, Reconciler: reconcile,
+		AdminToken: beego.AppConfig.String("admin_token"), BrokerUsername: brokerUsername, BrokerPassword: brokerPassword}
+	addRoutes(beego.BeeApp.Handlers, &ctr)
+}
+
+// 注册 Broker 的全部接口, 测试时注册到单独的 ControllerRegister
+func addRoutes(handlers *beego.ControllerRegister, ctr *Controller) {
 	//实现Broker要求的几个RestAPI，有些是可选的，具体看《服务发布规范》
-	beego.Router("/v2/catalog", &ctr, "get:GetServiceCatalog")
-	beego.Router("/v2/service_instances/:instance_id", &ctr, "put:CreateInstance")
-	beego.Router("/v2/service_instances/:instance_id", &ctr, "delete:DeleteInstance")
-	beego.Router("/v2/service_instances/:instance_id", &ctr, "patch:UpdateInstance")
-	beego.Router("/v2/service_instances/:instance_id/service_bindings/:binding_id", &ctr, "put:CreateBinding")
-	beego.Router("/v2/service_instances/:instance_id/service_bindings/:binding_id", &ctr, "delete:DeleteBinding")
-	beego.Router("/v2/service_instances/:instance_id/last_operation", &ctr, "get:LastOpertaion")
-	beego.Router("/v2/service_instances/:instance_id/status", &ctr, "get:GetInstanceStatus")
+	handlers.Add("/v2/catalog", ctr, "get:GetServiceCatalog")
+	handlers.Add("/health", ctr, "get:HealthCheck")
+	handlers.Add("/v2/service_instances/:instance_id", ctr, "put:CreateInstance")
+	handlers.Add("/v2/service_instances/:instance_id", ctr, "delete:DeleteInstance")
+	handlers.Add("/v2/service_instances/:instance_id", ctr, "patch:UpdateInstance")
+	handlers.Add("/v2/service_instances/:instance_id", ctr, "get:GetInstance")
+	handlers.Add("/v2/service_instances/:instance_id/service_bindings/:binding_id", ctr, "put:CreateBinding")
+	handlers.Add("/v2/service_instances/:instance_id/service_bindings/:binding_id", ctr, "delete:DeleteBinding")
+	handlers.Add("/v2/service_instances/:instance_id/service_bindings/:binding_id", ctr, "get:GetBinding")
+	handlers.Add("/v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation", ctr, "get:BindingLastOperation")
+	handlers.Add("/v2/service_instances/:instance_id/last_operation", ctr, "get:LastOpertaion")
+	handlers.Add("/v2/service_instances/:instance_id/status", ctr, "get:GetInstanceStatus")
+	//管理接口: 对账, 需要配置 admin_token 并在请求头 X-Admin-Token 中携带
+	handlers.Add("/admin/reconcile", ctr, "get:GetReconcileReport")
+	handlers.Add("/admin/reconcile", ctr, "post:Reconcile")
 	//测试自定义订购页面，自定义实例更新页面
-	beego.Router("/v2/provision", &ctr, "get:ProvisionWeb")
-	beego.Router("/v2/update", &ctr, "get:UpdateWeb")
+	handlers.Add("/v2/provision", ctr, "get:ProvisionWeb")
+	handlers.Add("/v2/update", ctr, "get:UpdateWeb")
 }
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 需要运维人员处理的 AOS stack 的原因
+const (
+	STACK_REASON_STUCK    = "stuck"    // 操作超时, stack 停留在中间状态
+	STACK_REASON_ROLLBACK = "rollback" // 创建实例失败后未能删除的 stack, 等待回收
+)
+
+var stacksBucket = []byte("stacks")
+
+// 需要运维人员关注的 AOS stack
+type StackRecord struct {
+	Region      string    `json:"region"`
+	AppId       string    `json:"app_id"`
+	StackName   string    `json:"stack_name,omitempty"`
+	InstanceId  string    `json:"instance_id,omitempty"`
+	Operation   string    `json:"operation,omitempty"`
+	Status      string    `json:"status,omitempty"` // 记录时 AOS 中的状态
+	Reason      string    `json:"reason"`
+	Description string    `json:"description,omitempty"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+func stackKey(region, appId string) []byte {
+	return []byte(region + "/" + appId)
+}
+
+// 保存 stack 记录, 同一个 stack 只保留最新一条
+func (s *Store) RecordStack(r *StackRecord) error {
+	if r.RecordedAt.IsZero() {
+		r.RecordedAt = time.Now()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stacksBucket).Put(stackKey(r.Region, r.AppId), data)
+	})
+}
+
+func (s *Store) ListStacks() ([]*StackRecord, error) {
+	var records []*StackRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(stacksBucket).ForEach(func(k, v []byte) error {
+			var r StackRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records = append(records, &r)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *Store) DeleteStack(region, appId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stacksBucket).Delete(stackKey(region, appId))
+	})
+}
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	OPERATION_CREATE = "create"
+	OPERATION_UPDATE = "update"
+	OPERATION_DELETE = "delete"
+
+	STATE_IN_PROGRESS = "in progress"
+	STATE_SUCCEEDED   = "succeeded"
+	STATE_FAILED      = "failed"
+
+	MAX_OPERATION_HISTORY = 20 // 每个实例保留的操作记录条数
+)
+
+var (
+	ErrNotFound = errors.New("instance not found")
+
+	instancesBucket = []byte("instances")
+)
+
+// 实例上的一次异步操作
+type Operation struct {
+	Kind        string    `json:"kind"`
+	State       string    `json:"state"`
+	Description string    `json:"description,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Errors      int       `json:"errors,omitempty"` // 连续查询后端失败的次数
+}
+
+func newOperation(kind string) Operation {
+	now := time.Now()
+	return Operation{
+		Kind:      kind,
+		State:     STATE_IN_PROGRESS,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// 是否为 kind 类型、startedAt 开始的那次操作
+func (o *Operation) Is(kind string, startedAt time.Time) bool {
+	return o.Kind == kind && o.StartedAt.Equal(startedAt)
+}
+
+func (o *Operation) finish(state, description string) {
+	o.State = state
+	o.Description = description
+	o.UpdatedAt = time.Now()
+}
+
+type Binding struct {
+	BindingId   string                 `json:"binding_id"`
+	AppGuid     string                 `json:"app_guid,omitempty"`
+	EnvName     string                 `json:"env_name,omitempty"` // 在 AppGuid 的 BIND_SERVICES 中的名称
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Credentials map[string]interface{} `json:"credentials,omitempty"`
+	Operation   *Operation             `json:"operation,omitempty"` // 异步绑定/解绑的进度, 同步完成的绑定为空
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
+func (b *Binding) StartOperation(kind string) {
+	op := newOperation(kind)
+	b.Operation = &op
+}
+
+func (b *Binding) FinishOperation(state, description string) {
+	if b.Operation != nil {
+		b.Operation.finish(state, description)
+	}
+}
+
+func (b *Binding) InProgress() bool {
+	return b.Operation != nil && b.Operation.State == STATE_IN_PROGRESS
+}
+
+// 异步创建失败的绑定, 平台可以重新创建
+func (b *Binding) Failed() bool {
+	return b.Operation != nil && b.Operation.Kind == OPERATION_CREATE && b.Operation.State == STATE_FAILED
+}
+
+// broker 侧保存的服务实例
+type Instance struct {
+	InstanceId       string                 `json:"instance_id"`
+	ServiceId        string                 `json:"service_id"`
+	PlanId           string                 `json:"plan_id"`
+	OrganizationGuid string                 `json:"organization_guid,omitempty"`
+	SpaceGuid        string                 `json:"space_guid,omitempty"`
+	Context          map[string]interface{} `json:"context,omitempty"`
+	Parameters       map[string]interface{} `json:"parameters,omitempty"`
+	Backend          string                 `json:"backend,omitempty"` // 为空表示 aos
+	StackName        string                 `json:"stack_name"`
+	AppId            string                 `json:"app_id"` // 后端资源 id, 例如 AOS app guid
+	Region           string                 `json:"region"`
+	DashboardUrl     string                 `json:"dashboard_url,omitempty"`
+	Lost             bool                   `json:"lost,omitempty"` // 对账时发现 AOS 中已没有该 app
+	Operations       []Operation            `json:"operations,omitempty"`
+	Bindings         map[string]*Binding    `json:"bindings,omitempty"`
+	CreatedAt        time.Time              `json:"created_at"`
+	UpdatedAt        time.Time              `json:"updated_at"`
+	// 不在实例存储中, 由请求中的 userdata 或 operation 构造, AppId 来自平台
+	Transient bool `json:"-"`
+}
+
+// 最近一次操作, 没有操作记录时返回 nil
+func (i *Instance) LastOperation() *Operation {
+	if len(i.Operations) == 0 {
+		return nil
+	}
+	return &i.Operations[len(i.Operations)-1]
+}
+
+// 开始一次新的操作
+func (i *Instance) StartOperation(kind string) *Operation {
+	i.Operations = append(i.Operations, newOperation(kind))
+	if len(i.Operations) > MAX_OPERATION_HISTORY {
+		i.Operations = i.Operations[len(i.Operations)-MAX_OPERATION_HISTORY:]
+	}
+	return i.LastOperation()
+}
+
+// 结束最近一次操作
+func (i *Instance) FinishOperation(state, description string) {
+	op := i.LastOperation()
+	if op != nil {
+		op.finish(state, description)
+	}
+}
+
+// 基于 BoltDB 的实例存储, 以 instance_id 为 key
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{instancesBucket, stacksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func getInstance(tx *bolt.Tx, instanceId string) (*Instance, error) {
+	data := tx.Bucket(instancesBucket).Get([]byte(instanceId))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	var inst Instance
+	if err := json.Unmarshal(data, &inst); err != nil {
+		return nil, err
+	}
+	return &inst, nil
+}
+
+func putInstance(tx *bolt.Tx, inst *Instance) error {
+	now := time.Now()
+	if inst.CreatedAt.IsZero() {
+		inst.CreatedAt = now
+	}
+	inst.UpdatedAt = now
+	data, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(instancesBucket).Put([]byte(inst.InstanceId), data)
+}
+
+// 实例不存在时返回 ErrNotFound
+func (s *Store) Get(instanceId string) (*Instance, error) {
+	var inst *Instance
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		inst, err = getInstance(tx, instanceId)
+		return err
+	})
+	return inst, err
+}
+
+func (s *Store) Put(inst *Instance) error {
+	if inst.InstanceId == "" {
+		return errors.New("instance id is empty")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putInstance(tx, inst)
+	})
+}
+
+// 在同一个事务中读取、修改并保存实例, fn 返回错误时不保存
+func (s *Store) Update(instanceId string, fn func(inst *Instance) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		inst, err := getInstance(tx, instanceId)
+		if err != nil {
+			return err
+		}
+		if err := fn(inst); err != nil {
+			return err
+		}
+		return putInstance(tx, inst)
+	})
+}
+
+func (s *Store) Delete(instanceId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(instancesBucket).Delete([]byte(instanceId))
+	})
+}
+
+func (s *Store) List() ([]*Instance, error) {
+	var instances []*Instance
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(instancesBucket).ForEach(func(k, v []byte) error {
+			var inst Instance
+			if err := json.Unmarshal(v, &inst); err != nil {
+				return err
+			}
+			instances = append(instances, &inst)
+			return nil
+		})
+	})
+	return instances, err
+}
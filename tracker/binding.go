@@ -0,0 +1,117 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/astaxie/beego"
+	"service-broker/store"
+)
+
+// 后台绑定/解绑的结果
+type bindingResult struct {
+	credentials map[string]interface{}
+	err         error
+}
+
+// 在后台执行绑定 bindingId 进行中的绑定或解绑, 结果写入绑定的 Operation, 平台通过绑定的 last_operation 查询.
+// 与实例操作使用相同的最长时间, 超时后绑定操作失败. 同一个绑定已在执行时忽略
+func (t *Tracker) RunBinding(instanceId, bindingId, token string) {
+	key := instanceId + "/" + bindingId
+	t.mu.Lock()
+	if t.bindings[key] {
+		t.mu.Unlock()
+		return
+	}
+	t.bindings[key] = true
+	t.mu.Unlock()
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.bindings, key)
+			t.mu.Unlock()
+		}()
+		t.runBinding(instanceId, bindingId, token)
+	}()
+}
+
+func (t *Tracker) runBinding(instanceId, bindingId, token string) {
+	inst, err := t.store.Get(instanceId)
+	if err != nil {
+		beego.Error("Load instance "+instanceId+" of binding "+bindingId+" fail! err:", err)
+		return
+	}
+	b, ok := inst.Bindings[bindingId]
+	if !ok || !b.InProgress() {
+		return
+	}
+	op := *b.Operation
+	limit := t.maxDuration(inst, op.Kind)
+	remaining := limit - time.Since(op.StartedAt)
+	if remaining <= 0 {
+		t.finishBinding(instanceId, bindingId, op, bindingResult{err: errors.New(op.Kind + " binding did not finish within " + limit.String())})
+		return
+	}
+	p, err := t.provisioners.ForInstance(inst)
+	if err != nil {
+		t.finishBinding(instanceId, bindingId, op, bindingResult{err: err})
+		return
+	}
+	//plan 已从 catalog 中移除时 plan 为 nil, 只能解绑
+	service, plan, ok := t.catalog.Plan(inst.ServiceId, inst.PlanId)
+	if !ok && op.Kind != store.OPERATION_DELETE {
+		t.finishBinding(instanceId, bindingId, op, bindingResult{err: errors.New("plan " + inst.PlanId + " of instance " + instanceId + " not found")})
+		return
+	}
+	done := make(chan bindingResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				beego.Error("Binding "+bindingId+" panic: ", r, "\n", string(debug.Stack()))
+				done <- bindingResult{err: fmt.Errorf("binding panic: %v", r)}
+			}
+		}()
+		var result bindingResult
+		if op.Kind == store.OPERATION_DELETE {
+			result.err = p.Unbind(inst, service, plan, b, token)
+		} else {
+			result.credentials, result.err = p.Bind(inst, service, plan, b, token)
+		}
+		done <- result
+	}()
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		t.finishBinding(instanceId, bindingId, op, result)
+	case <-timer.C:
+		beego.Error("Binding " + bindingId + " of instance " + instanceId + " did not finish within " + limit.String())
+		t.finishBinding(instanceId, bindingId, op, bindingResult{err: errors.New(op.Kind + " binding did not finish within " + limit.String())})
+	}
+}
+
+// 把绑定操作 op 的结果写入存储: 解绑成功时删除绑定记录. 绑定已删除或已开始其它操作时不写入
+func (t *Tracker) finishBinding(instanceId, bindingId string, op store.Operation, result bindingResult) {
+	err := t.store.Update(instanceId, func(inst *store.Instance) error {
+		saved, ok := inst.Bindings[bindingId]
+		if !ok || !saved.InProgress() || !saved.Operation.Is(op.Kind, op.StartedAt) {
+			return nil
+		}
+		switch {
+		case result.err != nil:
+			beego.Warn("Binding "+bindingId+" "+op.Kind+" fail! err:", result.err)
+			saved.FinishOperation(store.STATE_FAILED, result.err.Error())
+		case op.Kind == store.OPERATION_DELETE:
+			delete(inst.Bindings, bindingId)
+		default:
+			saved.Credentials = result.credentials
+			saved.FinishOperation(store.STATE_SUCCEEDED, "")
+		}
+		return nil
+	})
+	if err != nil && err != store.ErrNotFound {
+		beego.Error("Save binding "+bindingId+" fail! err:", err)
+	}
+}
@@ -0,0 +1,154 @@
+package tracker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"service-broker/aostest"
+	"service-broker/catalog"
+	"service-broker/store"
+)
+
+// 已创建完成的实例, 以及等待绑定到 consumer 的进行中的绑定
+func (e *env) putBinding(t *testing.T, kind string, startedAt time.Time) (appId, consumerId string) {
+	t.Helper()
+	stack := e.aos.AddStack("instance", "", aostest.STATUS_RUNNING)
+	consumer := e.aos.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	inst := &store.Instance{InstanceId: testInstanceId, ServiceId: e.service.Id, PlanId: e.plan.Id, StackName: "instance", AppId: stack.Id, Region: testRegion}
+	inst.StartOperation(store.OPERATION_CREATE)
+	inst.FinishOperation(store.STATE_SUCCEEDED, "")
+	b := &store.Binding{BindingId: testBindingId, AppGuid: consumer.Id, EnvName: testBindingId, CreatedAt: time.Now()}
+	b.StartOperation(kind)
+	b.Operation.StartedAt = startedAt
+	inst.Bindings = map[string]*store.Binding{testBindingId: b}
+	if err := e.store.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+	return stack.Id, consumer.Id
+}
+
+// 等待绑定操作结束, 绑定已删除时返回 nil
+func (e *env) waitBinding(t *testing.T) *store.Binding {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		inst, err := e.store.Get(testInstanceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, ok := inst.Bindings[testBindingId]
+		if !ok {
+			return nil
+		}
+		if !b.InProgress() {
+			return b
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("binding operation did not finish")
+	return nil
+}
+
+func TestAsyncBinding(t *testing.T) {
+	e := newEnv(t)
+	_, consumerId := e.putBinding(t, store.OPERATION_CREATE, time.Now())
+
+	e.tracker.RunBinding(testInstanceId, testBindingId, "")
+	b := e.waitBinding(t)
+	if b == nil || b.Operation.State != store.STATE_SUCCEEDED || b.Credentials["host"] != aostest.DEFAULT_HOST_IP {
+		t.Fatalf("binding after bind = %+v", b)
+	}
+	if entries := e.bindServices(t, consumerId, e.service.Name); len(entries) != 1 || entries[0].Name != testBindingId {
+		t.Fatalf("BIND_SERVICES after bind = %+v", entries)
+	}
+
+	err := e.store.Update(testInstanceId, func(inst *store.Instance) error {
+		inst.Bindings[testBindingId].StartOperation(store.OPERATION_DELETE)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.tracker.RunBinding(testInstanceId, testBindingId, "")
+	if b = e.waitBinding(t); b != nil {
+		t.Fatalf("binding after unbind = %+v", b)
+	}
+	if entries := e.bindServices(t, consumerId, e.service.Name); len(entries) != 0 {
+		t.Errorf("BIND_SERVICES after unbind = %+v", entries)
+	}
+}
+
+// 绑定失败时记录失败, 平台可以重新创建
+func TestAsyncBindingFails(t *testing.T) {
+	e := newEnv(t)
+	_, consumerId := e.putBinding(t, store.OPERATION_CREATE, time.Now())
+	e.aos.Inject(aostest.Failure{Op: aostest.OP_PUT_PROPERTIES, StackId: consumerId, StatusCode: 500})
+
+	e.tracker.RunBinding(testInstanceId, testBindingId, "")
+	if b := e.waitBinding(t); b == nil || !b.Failed() {
+		t.Errorf("binding = %+v, want failed", b)
+	}
+}
+
+// broker 重启后重新执行未完成的绑定操作
+func TestResumeBinding(t *testing.T) {
+	e := newEnv(t)
+	_, consumerId := e.putBinding(t, store.OPERATION_CREATE, time.Now())
+
+	restarted := New(e.store, e.tracker.provisioners, e.tracker.catalog, e.tracker.opts)
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if b := e.waitBinding(t); b == nil || b.Operation.State != store.STATE_SUCCEEDED {
+		t.Fatalf("binding after restart = %+v", b)
+	}
+	if entries := e.bindServices(t, consumerId, e.service.Name); len(entries) != 1 {
+		t.Errorf("BIND_SERVICES after restart = %+v", entries)
+	}
+}
+
+// 超过最长时间的绑定操作失败, 不再执行
+func TestBindingTimeout(t *testing.T) {
+	e := newEnv(t)
+	_, consumerId := e.putBinding(t, store.OPERATION_CREATE, time.Now().Add(-3*time.Hour))
+
+	e.tracker.RunBinding(testInstanceId, testBindingId, "")
+	b := e.waitBinding(t)
+	if b == nil || !b.Failed() || !strings.Contains(b.Operation.Description, "did not finish") {
+		t.Fatalf("binding = %+v, want timed out", b)
+	}
+	if entries := e.bindServices(t, consumerId, e.service.Name); len(entries) != 0 {
+		t.Errorf("BIND_SERVICES after timeout = %+v", entries)
+	}
+}
+
+// 阻塞在 Bind 中的后端
+type hangingBackend struct {
+	stubBackend
+	release chan struct{}
+}
+
+func (h *hangingBackend) Bind(inst *store.Instance, service *catalog.Service, plan *catalog.Plan, b *store.Binding, token string) (map[string]interface{}, error) {
+	<-h.release
+	return map[string]interface{}{"host": "late"}, nil
+}
+
+// 后端一直没有返回时, 超过最长时间后绑定失败, 之后返回的结果不再写入
+func TestBindingTimeoutWhileRunning(t *testing.T) {
+	e := newEnv(t)
+	e.putBinding(t, store.OPERATION_CREATE, time.Now())
+	backend := &hangingBackend{release: make(chan struct{})}
+	tracker := e.stubTracker(t, backend, Options{MaxDuration: 50 * time.Millisecond})
+
+	tracker.RunBinding(testInstanceId, testBindingId, "")
+	b := e.waitBinding(t)
+	close(backend.release)
+	if b == nil || !b.Failed() || !strings.Contains(b.Operation.Description, "did not finish") {
+		t.Fatalf("binding = %+v, want timed out", b)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if b = e.waitBinding(t); b.Credentials != nil {
+		t.Errorf("late credentials saved: %v", b.Credentials)
+	}
+}
@@ -0,0 +1,374 @@
+package tracker
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"service-broker/catalog"
+	"service-broker/provisioner"
+	"service-broker/store"
+)
+
+const (
+	DEFAULT_WORKERS      = 4
+	DEFAULT_INTERVAL     = 5 * time.Second // 第一次查询 AOS 的间隔
+	DEFAULT_MAX_INTERVAL = 60 * time.Second
+	DEFAULT_MAX_DURATION = 2 * time.Hour // plan 未配置 timeouts 时操作的最长时间
+	DEFAULT_MAX_ERRORS   = 10            // 连续查询 AOS 失败的次数达到该值时操作失败
+	QUEUE_SIZE           = 256
+)
+
+type Options struct {
+	Workers     int
+	Interval    time.Duration
+	MaxInterval time.Duration
+	MaxDuration time.Duration
+	MaxErrors   int
+}
+
+// 从 app.conf 读取 tracker_workers, tracker_interval, tracker_max_interval, tracker_max_duration(秒), tracker_max_errors
+func LoadOptions() Options {
+	return Options{
+		Workers:     beego.AppConfig.DefaultInt("tracker_workers", DEFAULT_WORKERS),
+		Interval:    time.Duration(beego.AppConfig.DefaultInt("tracker_interval", int(DEFAULT_INTERVAL/time.Second))) * time.Second,
+		MaxInterval: time.Duration(beego.AppConfig.DefaultInt("tracker_max_interval", int(DEFAULT_MAX_INTERVAL/time.Second))) * time.Second,
+		MaxDuration: time.Duration(beego.AppConfig.DefaultInt("tracker_max_duration", int(DEFAULT_MAX_DURATION/time.Second))) * time.Second,
+		MaxErrors:   beego.AppConfig.DefaultInt("tracker_max_errors", DEFAULT_MAX_ERRORS),
+	}
+}
+
+// 正在跟踪的实例
+type watch struct {
+	token    string
+	attempts int
+	next     time.Time // 下一次查询 AOS 的时间
+}
+
+// 未记录在实例存储中的操作连续查询失败的次数
+type queryErrors struct {
+	count   int
+	updated time.Time
+}
+
+// 在后台跟踪进行中的实例操作, 按退避间隔查询实例的后端并把结果写入实例存储,
+// last_operation 直接读取存储中的状态.
+type Tracker struct {
+	store        *store.Store
+	provisioners *provisioner.Registry
+	catalog      *catalog.Catalog
+	opts         Options
+	queue        chan string
+
+	mu        sync.Mutex
+	watches   map[string]*watch
+	untracked map[string]*queryErrors // key 为 untrackedKey
+	bindings  map[string]bool         // 正在后台执行的绑定操作, key 为 instance_id/binding_id
+}
+
+func New(instances *store.Store, provisioners *provisioner.Registry, services *catalog.Catalog, opts Options) *Tracker {
+	if opts.Workers <= 0 {
+		opts.Workers = DEFAULT_WORKERS
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DEFAULT_INTERVAL
+	}
+	if opts.MaxInterval < opts.Interval {
+		opts.MaxInterval = opts.Interval
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = DEFAULT_MAX_DURATION
+	}
+	if opts.MaxErrors <= 0 {
+		opts.MaxErrors = DEFAULT_MAX_ERRORS
+	}
+	return &Tracker{
+		store:        instances,
+		provisioners: provisioners,
+		catalog:      services,
+		opts:         opts,
+		queue:        make(chan string, QUEUE_SIZE),
+		watches:      make(map[string]*watch),
+		untracked:    make(map[string]*queryErrors),
+		bindings:     make(map[string]bool),
+	}
+}
+
+// 启动 worker, 并继续跟踪重启前未完成的实例操作, 重新执行未完成的绑定操作
+func (t *Tracker) Start() error {
+	for i := 0; i < t.opts.Workers; i++ {
+		go t.work()
+	}
+	instances, err := t.store.List()
+	if err != nil {
+		return err
+	}
+	for _, inst := range instances {
+		if op := inst.LastOperation(); op != nil && op.State == store.STATE_IN_PROGRESS {
+			t.Watch(inst.InstanceId, "")
+		}
+		for bindingId, b := range inst.Bindings {
+			if b.InProgress() {
+				t.RunBinding(inst.InstanceId, bindingId, "")
+			}
+		}
+	}
+	return nil
+}
+
+// 跟踪实例最近一次操作直到结束. 已在跟踪时只更新 token.
+// token 为空时使用区域配置的 token.
+func (t *Tracker) Watch(instanceId, token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w, ok := t.watches[instanceId]; ok {
+		if token != "" {
+			w.token = token
+		}
+		return
+	}
+	w := &watch{token: token}
+	t.watches[instanceId] = w
+	t.schedule(instanceId, w)
+}
+
+// 距下一次查询 AOS 的秒数, 用于 Retry-After; 未在跟踪时返回默认间隔
+func (t *Tracker) RetryAfter(instanceId string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delay := t.opts.Interval
+	if w, ok := t.watches[instanceId]; ok {
+		delay = time.Until(w.next)
+	}
+	seconds := int((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// 按查询次数指数退避, 调用方持有 t.mu
+func (t *Tracker) schedule(instanceId string, w *watch) {
+	delay := t.opts.Interval
+	for i := 0; i < w.attempts && delay < t.opts.MaxInterval; i++ {
+		delay *= 2
+	}
+	if delay > t.opts.MaxInterval {
+		delay = t.opts.MaxInterval
+	}
+	w.next = time.Now().Add(delay)
+	time.AfterFunc(delay, func() {
+		t.queue <- instanceId
+	})
+}
+
+func (t *Tracker) work() {
+	for instanceId := range t.queue {
+		t.mu.Lock()
+		w, ok := t.watches[instanceId]
+		var token string
+		if ok {
+			token = w.token
+		}
+		t.mu.Unlock()
+		if !ok {
+			continue
+		}
+		done := t.check(instanceId, token)
+		t.mu.Lock()
+		if done {
+			delete(t.watches, instanceId)
+		} else {
+			w.attempts++
+			t.schedule(instanceId, w)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// 查询一次 AOS 并更新存储, 操作已结束时返回 true.
+// 查询期间平台可能发起了新的操作, 此时不写入原操作的结果, 继续跟踪新的操作
+func (t *Tracker) check(instanceId, token string) bool {
+	inst, err := t.store.Get(instanceId)
+	if err != nil {
+		if err != store.ErrNotFound {
+			beego.Error("Load instance "+instanceId+" fail! err:", err)
+			return false
+		}
+		return true
+	}
+	last := inst.LastOperation()
+	if last == nil || last.State != store.STATE_IN_PROGRESS {
+		return true
+	}
+	op := *last
+	status, stuck, err := t.query(inst, op.Kind, token, op.StartedAt, op.Errors)
+	if err != nil {
+		//连续失败的次数记录在操作上, broker 重启后继续累计
+		t.updateOperation(instanceId, op, func(inst *store.Instance) {
+			inst.LastOperation().Errors = op.Errors + 1
+		})
+		return false
+	}
+	if status.State == store.STATE_IN_PROGRESS {
+		if op.Errors > 0 {
+			t.updateOperation(instanceId, op, func(inst *store.Instance) {
+				inst.LastOperation().Errors = 0
+			})
+		}
+		return false
+	}
+	if !t.finish(instanceId, op, status.State, status.Description, status.DashboardUrl) {
+		return false
+	}
+	if stuck != nil {
+		t.recordStuck(stuck)
+	}
+	return true
+}
+
+// 查询未记录在实例存储中的操作, 例如平台带 userdata 或 operation 查询的早期实例. 与后台跟踪使用相同的判定:
+// 查询后端失败时返回进行中, 连续失败达到 MaxErrors 次或超过最长时间后返回失败, 超时的 stack 同样记录供运维处理.
+// startedAt 为零值(平台未带回 operation)时不判断超时
+func (t *Tracker) Query(inst *store.Instance, kind, token string, startedAt time.Time) *provisioner.OperationStatus {
+	key := untrackedKey(inst, kind, startedAt)
+	t.mu.Lock()
+	var errs int
+	if e, ok := t.untracked[key]; ok {
+		errs = e.count
+	}
+	t.mu.Unlock()
+	status, stuck, err := t.query(inst, kind, token, startedAt, errs)
+	t.mu.Lock()
+	if err != nil {
+		t.pruneUntracked()
+		t.untracked[key] = &queryErrors{count: errs + 1, updated: time.Now()}
+	} else {
+		delete(t.untracked, key)
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return &provisioner.OperationStatus{
+			State:       store.STATE_IN_PROGRESS,
+			Description: "query operation fail, will retry: " + err.Error(),
+		}
+	}
+	if stuck != nil {
+		t.recordStuck(stuck)
+	}
+	return status
+}
+
+func untrackedKey(inst *store.Instance, kind string, startedAt time.Time) string {
+	return inst.InstanceId + "/" + inst.AppId + "/" + kind + "/" + strconv.FormatInt(startedAt.UnixNano(), 10)
+}
+
+// 平台不再轮询的操作不会查询成功, 超过最长时间后丢弃其失败次数, 调用方持有 t.mu
+func (t *Tracker) pruneUntracked() {
+	for key, e := range t.untracked {
+		if time.Since(e.updated) > t.opts.MaxDuration {
+			delete(t.untracked, key)
+		}
+	}
+}
+
+// 查询一次 inst 上 kind 操作的进展, errs 为此前连续查询失败的次数. 查询失败时返回 error,
+// 达到 MaxErrors 次时不再返回 error 而是返回失败的状态. 超过最长时间时返回失败的状态和需要记录的 stack.
+// 后端 panic 时记录日志并按查询失败处理, 避免 worker 退出导致 broker 崩溃
+func (t *Tracker) query(inst *store.Instance, kind, token string, startedAt time.Time, errs int) (status *provisioner.OperationStatus, stuck *store.StackRecord, err error) {
+	instanceId := inst.InstanceId
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("Check operation of instance "+instanceId+" panic: ", r, "\n", string(debug.Stack()))
+			status, stuck, err = t.queryFailed(kind, errs, fmt.Errorf("check operation panic: %v", r))
+		}
+	}()
+	p, err := t.provisioners.ForInstance(inst)
+	if err != nil {
+		beego.Error("Get backend of instance "+instanceId+" fail! err:", err)
+		return &provisioner.OperationStatus{State: store.STATE_FAILED, Description: err.Error()}, nil, nil
+	}
+	status, err = p.LastOperation(inst, kind, token)
+	if err != nil {
+		beego.Warn("Query operation of instance "+instanceId+" fail! err:", err)
+		return t.queryFailed(kind, errs, err)
+	}
+	if status.State != store.STATE_IN_PROGRESS {
+		return status, nil, nil
+	}
+	beego.Debug("instance "+instanceId+" status:", status.Status)
+	//超时后操作失败, 并记录停留在中间状态的 stack 供运维处理
+	limit := t.maxDuration(inst, kind)
+	if elapsed := time.Since(startedAt); !startedAt.IsZero() && elapsed > limit {
+		description := kind + " did not finish within " + limit.String() + ", " + inst.StackName + " is still " + status.Status
+		beego.Error("Operation of instance "+instanceId+" timed out: ", description)
+		stuck = &store.StackRecord{
+			Region:      inst.Region,
+			AppId:       inst.AppId,
+			StackName:   inst.StackName,
+			InstanceId:  instanceId,
+			Operation:   kind,
+			Status:      status.Status,
+			Reason:      store.STACK_REASON_STUCK,
+			Description: description,
+		}
+		return &provisioner.OperationStatus{State: store.STATE_FAILED, Description: description, Status: status.Status}, stuck, nil
+	}
+	return status, nil, nil
+}
+
+// 查询失败的次数未达到 MaxErrors 时返回 err, 否则返回失败的状态
+func (t *Tracker) queryFailed(kind string, errs int, err error) (*provisioner.OperationStatus, *store.StackRecord, error) {
+	if errs+1 < t.opts.MaxErrors {
+		return nil, nil, err
+	}
+	description := kind + " failed: query backend failed " + strconv.Itoa(errs+1) + " times in a row, last error: " + err.Error()
+	return &provisioner.OperationStatus{State: store.STATE_FAILED, Description: description}, nil, nil
+}
+
+func (t *Tracker) recordStuck(stuck *store.StackRecord) {
+	if err := t.store.RecordStack(stuck); err != nil {
+		beego.Error("Record stuck stack "+stuck.AppId+" fail! err:", err)
+	}
+}
+
+// plan 配置的操作最长时间, 未配置时使用默认值
+func (t *Tracker) maxDuration(inst *store.Instance, kind string) time.Duration {
+	if _, plan, ok := t.catalog.Plan(inst.ServiceId, inst.PlanId); ok {
+		if limit := plan.MaxDuration(kind); limit > 0 {
+			return limit
+		}
+	}
+	return t.opts.MaxDuration
+}
+
+// 把操作 op 的结果写入存储, 返回是否写入; 实例最近一次操作已不是 op 时(例如查询期间平台发起了删除)不写入
+func (t *Tracker) finish(instanceId string, op store.Operation, state, description, dashboardUrl string) bool {
+	return t.updateOperation(instanceId, op, func(inst *store.Instance) {
+		inst.FinishOperation(state, description)
+		if dashboardUrl != "" {
+			inst.DashboardUrl = dashboardUrl
+		}
+	})
+}
+
+// 实例最近一次操作仍是 op 时执行 fn 并保存, 返回是否执行; 实例已删除时视为执行
+func (t *Tracker) updateOperation(instanceId string, op store.Operation, fn func(inst *store.Instance)) bool {
+	updated := false
+	err := t.store.Update(instanceId, func(inst *store.Instance) error {
+		if last := inst.LastOperation(); last == nil || !last.Is(op.Kind, op.StartedAt) {
+			beego.Info("Operation " + op.Kind + " of instance " + instanceId + " was superseded")
+			return nil
+		}
+		fn(inst)
+		updated = true
+		return nil
+	})
+	if err != nil && err != store.ErrNotFound {
+		beego.Error("Save operation state of instance "+instanceId+" fail! err:", err)
+	}
+	return updated || err == store.ErrNotFound
+}
@@ -0,0 +1,461 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"service-broker/aos"
+	"service-broker/aostest"
+	"service-broker/catalog"
+	"service-broker/provisioner"
+	"service-broker/store"
+)
+
+const (
+	testRegion     = "r1"
+	testInstanceId = "5b1a7c1e-6a3f-4b0a-9a6e-3c2f5e1d0a01"
+	testBindingId  = "binding-1"
+)
+
+const testCatalog = `
+services:
+- id: service-1
+  name: redis
+  description: redis
+  bindable: true
+  plans:
+  - id: plan-1
+    name: small
+    description: small
+    blueprint_id: blueprint-1
+    binding:
+      strategy: outputs
+      outputs:
+        host: hostip
+        port: address_port
+`
+
+type env struct {
+	aos     *aostest.Server
+	store   *store.Store
+	backend *provisioner.AOS
+	tracker *Tracker
+	service *catalog.Service
+	plan    *catalog.Plan
+}
+
+func newEnv(t *testing.T) *env {
+	dir, err := ioutil.TempDir("", "tracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	instances, err := store.Open(filepath.Join(dir, "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instances.Close() })
+	server := aostest.NewServer()
+	t.Cleanup(server.Close)
+	regions, err := aos.NewRegistry(testRegion, server.Region(testRegion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := catalog.Parse([]byte(testCatalog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &provisioner.AOS{Regions: regions, Store: instances, RollbackTimeout: time.Second}
+	provisioners, err := provisioner.NewRegistry(provisioner.BACKEND_AOS, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := New(instances, provisioners, services, Options{Workers: 2, Interval: 10 * time.Millisecond, MaxInterval: 20 * time.Millisecond})
+	if err = tracker.Start(); err != nil {
+		t.Fatal(err)
+	}
+	service, plan, _ := services.Plan("service-1", "plan-1")
+	return &env{aos: server, store: instances, backend: backend, tracker: tracker, service: service, plan: plan}
+}
+
+// 等待实例最近一次操作结束
+func (e *env) wait(t *testing.T, instanceId string) *store.Instance {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		inst, err := e.store.Get(instanceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op := inst.LastOperation(); op != nil && op.State != store.STATE_IN_PROGRESS {
+			return inst
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("operation of instance " + instanceId + " did not finish")
+	return nil
+}
+
+// 使用方应用节点上 BIND_SERVICES 中 service 的条目
+func (e *env) bindServices(t *testing.T, appId, serviceName string) []aos.EnvSetEntity {
+	t.Helper()
+	stack, ok := e.aos.Stack(appId)
+	if !ok {
+		t.Fatal("consumer app " + appId + " not found")
+	}
+	var body aos.SetEnvbody
+	if err := json.Unmarshal(stack.Nodes[0].Properties, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.BindEnv.BindServices[serviceName]
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	e := newEnv(t)
+
+	//创建
+	stackName := aos.GetStackName(aos.INSTANCE_STACK_PREFIX, e.service.Name, testInstanceId)
+	appId, err := e.backend.Provision(&provisioner.ProvisionRequest{
+		InstanceId: testInstanceId,
+		Name:       stackName,
+		Region:     testRegion,
+		Plan:       e.plan,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := &store.Instance{
+		InstanceId: testInstanceId,
+		ServiceId:  e.service.Id,
+		PlanId:     e.plan.Id,
+		Backend:    provisioner.BACKEND_AOS,
+		StackName:  stackName,
+		AppId:      appId,
+		Region:     testRegion,
+	}
+	inst.StartOperation(store.OPERATION_CREATE)
+	if err = e.store.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+	e.tracker.Watch(testInstanceId, "")
+
+	inst = e.wait(t, testInstanceId)
+	if op := inst.LastOperation(); op.State != store.STATE_SUCCEEDED {
+		t.Fatalf("create: state %s, %s", op.State, op.Description)
+	}
+	stack, _ := e.aos.Stack(appId)
+	wantUrl := "http://" + aostest.DEFAULT_HOST_IP + ":" + strconv.Itoa(stack.Nodes[0].NodePort)
+	if inst.DashboardUrl != wantUrl {
+		t.Errorf("dashboard url = %q, want %q", inst.DashboardUrl, wantUrl)
+	}
+
+	//绑定到使用方应用
+	consumer := e.aos.AddStack("consumer", "", aostest.STATUS_RUNNING)
+	b := &store.Binding{BindingId: testBindingId, AppGuid: consumer.Id, EnvName: testBindingId}
+	credentials, err := e.backend.Bind(inst, e.service, e.plan, b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials["host"] != aostest.DEFAULT_HOST_IP || credentials["port"] == nil {
+		t.Errorf("credentials = %v", credentials)
+	}
+	b.Credentials = credentials
+	entries := e.bindServices(t, consumer.Id, e.service.Name)
+	if len(entries) != 1 || entries[0].Name != testBindingId || entries[0].Plan != e.plan.Name {
+		t.Fatalf("BIND_SERVICES after bind = %+v", entries)
+	}
+	if consumer, _ = e.aos.Stack(consumer.Id); len(consumer.Actions) != 1 || consumer.Actions[0].Lifecycle != aostest.LIFECYCLE_RECONFIGURE {
+		t.Errorf("consumer actions = %+v", consumer.Actions)
+	}
+
+	//解绑
+	if err = e.backend.Unbind(inst, e.service, e.plan, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if entries = e.bindServices(t, consumer.Id, e.service.Name); len(entries) != 0 {
+		t.Fatalf("BIND_SERVICES after unbind = %+v", entries)
+	}
+
+	//删除
+	if err = e.backend.Deprovision(inst, ""); err != nil {
+		t.Fatal(err)
+	}
+	err = e.store.Update(testInstanceId, func(inst *store.Instance) error {
+		inst.StartOperation(store.OPERATION_DELETE)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.tracker.Watch(testInstanceId, "")
+	inst = e.wait(t, testInstanceId)
+	if op := inst.LastOperation(); op.State != store.STATE_SUCCEEDED {
+		t.Fatalf("delete: state %s, %s", op.State, op.Description)
+	}
+	if _, ok := e.aos.Stack(appId); ok {
+		t.Error("stack still exists after delete")
+	}
+}
+
+func TestCreateFailsWhenStackAbnormal(t *testing.T) {
+	e := newEnv(t)
+	e.aos.Script(aostest.LIFECYCLE_CREATE, aostest.STATUS_PROCESSING, aostest.STATUS_ABNORMAL)
+
+	appId, err := e.backend.Provision(&provisioner.ProvisionRequest{
+		InstanceId: testInstanceId,
+		Name:       aos.GetStackName(aos.INSTANCE_STACK_PREFIX, e.service.Name, testInstanceId),
+		Region:     testRegion,
+		Plan:       e.plan,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := &store.Instance{InstanceId: testInstanceId, PlanId: e.plan.Id, ServiceId: e.service.Id, AppId: appId, Region: testRegion}
+	inst.StartOperation(store.OPERATION_CREATE)
+	if err = e.store.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+	e.tracker.Watch(testInstanceId, "")
+	if op := e.wait(t, testInstanceId).LastOperation(); op.State != store.STATE_FAILED {
+		t.Errorf("state = %s, want failed", op.State)
+	}
+}
+
+// 按 lastOperation 返回操作进展的后端, 用于构造查询期间的并发操作; 其它方法不会被调用
+type stubBackend struct {
+	provisioner.Provisioner
+	lastOperation func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error)
+}
+
+func (s *stubBackend) Type() string {
+	return "stub"
+}
+
+func (s *stubBackend) LastOperation(inst *store.Instance, kind, token string) (*provisioner.OperationStatus, error) {
+	return s.lastOperation(inst, kind)
+}
+
+// 使用 backend 作为默认后端、不启动 worker 的 tracker, 由测试直接调用 check
+func (e *env) stubTracker(t *testing.T, backend provisioner.Provisioner, opts Options) *Tracker {
+	t.Helper()
+	provisioners, err := provisioner.NewRegistry(backend.Type(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := catalog.Parse([]byte(testCatalog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(e.store, provisioners, services, opts)
+}
+
+// 创建中的实例
+func (e *env) putCreating(t *testing.T) *store.Instance {
+	t.Helper()
+	inst := &store.Instance{InstanceId: testInstanceId, ServiceId: e.service.Id, PlanId: e.plan.Id, StackName: "stack", AppId: "app-1", Region: testRegion}
+	inst.StartOperation(store.OPERATION_CREATE)
+	if err := e.store.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// 查询创建进展期间平台发起了删除, 创建的结果不能写到删除操作上
+func TestSupersededOperation(t *testing.T) {
+	e := newEnv(t)
+	e.putCreating(t)
+	stub := &stubBackend{lastOperation: func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		if kind != store.OPERATION_CREATE {
+			return &provisioner.OperationStatus{State: store.STATE_IN_PROGRESS, Status: aostest.STATUS_PROCESSING}, nil
+		}
+		err := e.store.Update(inst.InstanceId, func(inst *store.Instance) error {
+			inst.StartOperation(store.OPERATION_DELETE)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &provisioner.OperationStatus{State: store.STATE_SUCCEEDED, Status: aostest.STATUS_RUNNING}, nil
+	}}
+	tracker := e.stubTracker(t, stub, Options{})
+
+	if tracker.check(testInstanceId, "") {
+		t.Error("check finished tracking the superseded operation")
+	}
+	inst, err := e.store.Get(testInstanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op := inst.LastOperation(); op.Kind != store.OPERATION_DELETE || op.State != store.STATE_IN_PROGRESS {
+		t.Errorf("last operation = %s %s, want delete in progress", op.Kind, op.State)
+	}
+	if op := inst.Operations[0]; op.State != store.STATE_IN_PROGRESS {
+		t.Errorf("superseded create = %s", op.State)
+	}
+
+	//继续跟踪新的删除操作
+	if tracker.check(testInstanceId, "") {
+		t.Error("check finished tracking the delete in progress")
+	}
+}
+
+// 连续查询失败的次数记录在操作上, 重启后继续累计, 达到 MaxErrors 时操作失败
+func TestQueryErrorThreshold(t *testing.T) {
+	e := newEnv(t)
+	e.putCreating(t)
+	queryErr := errors.New("connection refused")
+	stub := &stubBackend{lastOperation: func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		return nil, queryErr
+	}}
+	opts := Options{MaxErrors: 3}
+	errorsOf := func() int {
+		inst, err := e.store.Get(testInstanceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inst.LastOperation().Errors
+	}
+
+	tracker := e.stubTracker(t, stub, opts)
+	for i := 1; i <= 2; i++ {
+		if tracker.check(testInstanceId, "") {
+			t.Fatalf("check %d finished the operation", i)
+		}
+		if n := errorsOf(); n != i {
+			t.Errorf("errors after check %d = %d", i, n)
+		}
+	}
+	//查询成功后清零
+	queryErr = nil
+	stub.lastOperation = func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		return &provisioner.OperationStatus{State: store.STATE_IN_PROGRESS, Status: aostest.STATUS_PROCESSING}, nil
+	}
+	tracker.check(testInstanceId, "")
+	if n := errorsOf(); n != 0 {
+		t.Errorf("errors after successful query = %d", n)
+	}
+
+	queryErr = errors.New("connection refused")
+	stub.lastOperation = func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		return nil, queryErr
+	}
+	tracker.check(testInstanceId, "")
+	tracker.check(testInstanceId, "")
+	//重启后的 tracker 继续累计
+	tracker = e.stubTracker(t, stub, opts)
+	if !tracker.check(testInstanceId, "") {
+		t.Fatal("check did not finish the operation after 3 errors")
+	}
+	inst, err := e.store.Get(testInstanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op := inst.LastOperation(); op.State != store.STATE_FAILED || !strings.Contains(op.Description, "3 times") {
+		t.Errorf("operation = %s, %s", op.State, op.Description)
+	}
+}
+
+// 超过最长时间后操作失败, 并记录停留在中间状态的 stack
+func TestOperationTimeout(t *testing.T) {
+	e := newEnv(t)
+	inst := &store.Instance{InstanceId: testInstanceId, ServiceId: e.service.Id, PlanId: e.plan.Id, StackName: "stack", AppId: "app-1", Region: testRegion}
+	inst.StartOperation(store.OPERATION_CREATE).StartedAt = time.Now().Add(-time.Hour)
+	if err := e.store.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubBackend{lastOperation: func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		return &provisioner.OperationStatus{State: store.STATE_IN_PROGRESS, Status: aostest.STATUS_PROCESSING}, nil
+	}}
+	tracker := e.stubTracker(t, stub, Options{MaxDuration: time.Minute})
+
+	if !tracker.check(testInstanceId, "") {
+		t.Fatal("check did not finish the timed out operation")
+	}
+	inst, err := e.store.Get(testInstanceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op := inst.LastOperation(); op.State != store.STATE_FAILED {
+		t.Errorf("state = %s, want failed", op.State)
+	}
+	checkStuck(t, e.store, "app-1", store.OPERATION_CREATE)
+}
+
+// 记录了 appId 的 kind 操作超时
+func checkStuck(t *testing.T, instances *store.Store, appId, kind string) {
+	t.Helper()
+	stacks, err := instances.ListStacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stacks) != 1 || stacks[0].AppId != appId || stacks[0].Reason != store.STACK_REASON_STUCK ||
+		stacks[0].Operation != kind || stacks[0].Status != aostest.STATUS_PROCESSING {
+		t.Errorf("recorded stacks = %+v", stacks)
+	}
+}
+
+// 未记录在存储中的操作: 查询失败时返回进行中, 连续失败达到 MaxErrors 时返回失败
+func TestQueryUntracked(t *testing.T) {
+	e := newEnv(t)
+	var queryErr error
+	stub := &stubBackend{lastOperation: func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		if queryErr != nil {
+			return nil, queryErr
+		}
+		return &provisioner.OperationStatus{State: store.STATE_IN_PROGRESS, Status: aostest.STATUS_PROCESSING}, nil
+	}}
+	tracker := e.stubTracker(t, stub, Options{MaxErrors: 3})
+	inst := &store.Instance{InstanceId: testInstanceId, AppId: "app-1", Region: testRegion, Transient: true}
+	startedAt := time.Now()
+
+	queryErr = errors.New("connection refused")
+	for i := 1; i <= 2; i++ {
+		if status := tracker.Query(inst, store.OPERATION_CREATE, "", startedAt); status.State != store.STATE_IN_PROGRESS {
+			t.Errorf("query %d: state = %s", i, status.State)
+		}
+	}
+	//其它操作单独计数
+	if status := tracker.Query(inst, store.OPERATION_CREATE, "", startedAt.Add(time.Second)); status.State != store.STATE_IN_PROGRESS {
+		t.Errorf("other operation: state = %s", status.State)
+	}
+	//查询成功后清零
+	queryErr = nil
+	tracker.Query(inst, store.OPERATION_CREATE, "", startedAt)
+	queryErr = errors.New("connection refused")
+	for i := 1; i <= 2; i++ {
+		if status := tracker.Query(inst, store.OPERATION_CREATE, "", startedAt); status.State != store.STATE_IN_PROGRESS {
+			t.Errorf("query %d after success: state = %s", i, status.State)
+		}
+	}
+	if status := tracker.Query(inst, store.OPERATION_CREATE, "", startedAt); status.State != store.STATE_FAILED || !strings.Contains(status.Description, "3 times") {
+		t.Errorf("query after 3 errors = %+v", status)
+	}
+	if _, err := e.store.Get(testInstanceId); err != store.ErrNotFound {
+		t.Errorf("untracked instance saved: %v", err)
+	}
+}
+
+// 未记录在存储中的操作超时后返回失败并记录 stack; 平台未带回 operation 时不知道开始时间, 不判断超时
+func TestQueryUntrackedTimeout(t *testing.T) {
+	e := newEnv(t)
+	stub := &stubBackend{lastOperation: func(inst *store.Instance, kind string) (*provisioner.OperationStatus, error) {
+		return &provisioner.OperationStatus{State: store.STATE_IN_PROGRESS, Status: aostest.STATUS_PROCESSING}, nil
+	}}
+	tracker := e.stubTracker(t, stub, Options{MaxDuration: time.Minute})
+	inst := &store.Instance{InstanceId: testInstanceId, AppId: "app-1", StackName: "stack", Region: testRegion, Transient: true}
+
+	if status := tracker.Query(inst, store.OPERATION_UPDATE, "", time.Time{}); status.State != store.STATE_IN_PROGRESS {
+		t.Errorf("query without start time: state = %s", status.State)
+	}
+	if status := tracker.Query(inst, store.OPERATION_UPDATE, "", time.Now().Add(-time.Hour)); status.State != store.STATE_FAILED {
+		t.Errorf("query after timeout: state = %s", status.State)
+	}
+	checkStuck(t, e.store, "app-1", store.OPERATION_UPDATE)
+}